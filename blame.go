@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Prints each line of a file in HEAD with the flush that last changed it.
+// -L <start>,<end> limits the output to a range of lines, where either bound
+// may be left out.
+func cmdBlame(args []string) {
+	path := ""
+	lineRange := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-L" && i+1 < len(args) {
+			lineRange = args[i+1]
+			i++
+		} else if path == "" && !strings.HasPrefix(args[i], "-") {
+			path = args[i]
+		} else {
+			exitUsage()
+		}
+	}
+	if path == "" {
+		exitUsage()
+	}
+
+	head := getHead()
+	if head == nil {
+		fmt.Println("There are no flushes yet to blame.")
+		os.Exit(1)
+	}
+	if findNode(getObject(head.TreeHash).ToTree(), path) == nil {
+		fmt.Printf("%s is not a file in HEAD.\n", quotePath(path))
+		os.Exit(1)
+	}
+	lines, flushes := blame(*head, path)
+	start, end := parseLineRange(lineRange, len(lines))
+
+	authorWidth := 0
+	for _, flush := range flushes[start-1 : end] {
+		authorWidth = max(authorWidth, len(blameAuthor(flush)))
+	}
+	numberWidth := len(strconv.Itoa(end))
+	for i := start - 1; i < end; i++ {
+		flush := flushes[i]
+		fmt.Printf("%s (%-*s %s %*d) %s\n", flush.Object.Hash[:7], authorWidth, blameAuthor(flush), flush.Date, numberWidth, i+1, strings.TrimSuffix(lines[i], "\n"))
+	}
+}
+
+// Parses a 1-based inclusive line range, exiting with status 1 if it is not
+// within the file
+func parseLineRange(lineRange string, lineCount int) (int, int) {
+	if lineRange == "" {
+		return 1, lineCount
+	}
+	startStr, endStr, _ := strings.Cut(lineRange, ",")
+	start, end := 1, lineCount
+	var startErr, endErr error
+	if startStr != "" {
+		start, startErr = strconv.Atoi(startStr)
+	}
+	if endStr != "" {
+		end, endErr = strconv.Atoi(endStr)
+	}
+	if startErr != nil || endErr != nil || start < 1 {
+		fmt.Printf("Invalid line range %s, expected -L <start>,<end>.\n", lineRange)
+		exitUsage()
+	}
+	if start > lineCount || end > lineCount {
+		fmt.Printf("The file has only %d lines.\n", lineCount)
+		os.Exit(1)
+	}
+	if end < start {
+		fmt.Printf("Invalid line range %s, the end is before the start.\n", lineRange)
+		exitUsage()
+	}
+	return start, end
+}
+
+func blameAuthor(flush Flush) string {
+	if flush.Author == "" {
+		return "Unknown"
+	}
+	return flush.Author
+}
+
+// Returns the lines of a file in a flush, and for each line the flush that
+// last changed it. The history is walked from the flush through its parents,
+// diffing each version of the file with the previous one. Lines that are
+// unchanged by a flush are passed on to its parent, the others are attributed
+// to it.
+func blame(flush Flush, path string) ([]string, []Flush) {
+	object := findNode(getObject(flush.TreeHash).ToTree(), path)
+	lines := splitLines(object.Content)
+	flushes := make([]Flush, len(lines))
+
+	// The index in lines of each line of the current version, or -1 for lines
+	// that are already attributed
+	pending := make([]int, len(lines))
+	for i := range pending {
+		pending[i] = i
+	}
+	attributePending := func(flush Flush) {
+		for _, i := range pending {
+			if i >= 0 {
+				flushes[i] = flush
+			}
+		}
+	}
+	currentLines := lines
+	for slices.ContainsFunc(pending, func(i int) bool { return i >= 0 }) {
+		if flush.ParentHash == "" {
+			attributePending(flush)
+			break
+		}
+		parentFlush := getFlush(flush.ParentHash)
+		parent := findNode(getObject(parentFlush.TreeHash).ToTree(), path)
+		if parent == nil {
+			// The file was added by this flush
+			attributePending(flush)
+			break
+		}
+		if parent.Hash == object.Hash {
+			flush = parentFlush
+			continue
+		}
+
+		parentLines := splitLines(parent.Content)
+		parentPending := make([]int, len(parentLines))
+		for i := range parentPending {
+			parentPending[i] = -1
+		}
+		a, b := 0, 0
+		hunks := append(diffLines(parentLines, currentLines), DiffHunk{len(parentLines), len(parentLines), len(currentLines), len(currentLines)})
+		for _, hunk := range hunks {
+			for ; b < hunk.BStart; a, b = a+1, b+1 {
+				parentPending[a] = pending[b]
+			}
+			for ; b < hunk.BEnd; b++ {
+				if pending[b] >= 0 {
+					flushes[pending[b]] = flush
+				}
+			}
+			a = hunk.AEnd
+		}
+
+		pending = parentPending
+		currentLines = parentLines
+		object = parent
+		flush = parentFlush
+	}
+	return lines, flushes
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const DEFAULT_COMPRESSION = "zlib"
+
+// A codec compresses objects, both loose and in packs. The codec used for
+// writing is chosen per repository with core.compression, and its level with
+// core.compressionLevel. Readers detect the codec from the stored bytes, so
+// changing the codec does not require rewriting existing objects.
+type Codec struct {
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var CODECS = map[string]Codec{
+	"zlib": {
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		NewReader: zlib.NewReader,
+	},
+	"zstd": {
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			encoderLevel := zstd.SpeedDefault
+			if level != zlib.DefaultCompression {
+				if level < 1 || level > 22 {
+					return nil, fmt.Errorf("zstd: invalid compression level: %d", level)
+				}
+				encoderLevel = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	"none": {
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Returns a writer compressing with the codec of the repository
+func newCompressor(w io.Writer) io.WriteCloser {
+	config := getConfig()
+	name := config.Get("core.compression", DEFAULT_COMPRESSION)
+	codec, supported := CODECS[name]
+	if !supported {
+		panic(fmt.Sprintf("Unsupported compression %s, expected zlib, zstd or none", name))
+	}
+	level := int(config.GetInt("core.compressionLevel", zlib.DefaultCompression))
+	compressor, err := codec.NewWriter(w, level)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid compression level %d for %s: %s", level, name, err))
+	}
+	return compressor
+}
+
+// Returns an error if the codec is unknown or doesn't support the level
+func checkCompression(name string, level int) error {
+	codec, supported := CODECS[name]
+	if !supported {
+		return fmt.Errorf("Unsupported compression %s, expected zlib, zstd or none.", name)
+	}
+	compressor, err := codec.NewWriter(io.Discard, level)
+	if err != nil {
+		return fmt.Errorf("Invalid compression level %d for %s: %s.", level, name, err)
+	}
+	compressor.Close()
+	return nil
+}
+
+// Returns a reader decompressing with the codec detected from the first bytes
+// of r. Uncompressed objects start with their type name, which can't be
+// mistaken for a zlib or zstd header.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len("flush\n\n"))
+	name := detectCodec(magic)
+	if name == "" {
+		return nil, fmt.Errorf("unknown compression")
+	}
+	return CODECS[name].NewReader(buffered)
+}
+
+// Returns the codec of the stored bytes of an object, or an empty string if
+// they are neither compressed nor start with an object header
+func detectCodec(magic []byte) string {
+	if bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		return "zstd"
+	}
+	if len(magic) >= 2 && magic[0]&0x0f == 8 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+		return "zlib"
+	}
+	for _, objectType := range []string{"file", "tree", "flush"} {
+		if bytes.HasPrefix(magic, []byte(objectType+"\n\n")) {
+			return "none"
+		}
+	}
+	return ""
+}
+
+func compress(b []byte) *bytes.Buffer {
+	var buf = new(bytes.Buffer)
+	w := newCompressor(buf)
+	w.Write(b)
+	w.Close()
+	return buf
+}
+
+// Compresses delta instructions for a pack. Deltas have no object header to
+// detect them by, so they are compressed with zlib even if the repository
+// stores objects uncompressed.
+func compressDelta(delta []byte) *bytes.Buffer {
+	if getConfig().Get("core.compression", DEFAULT_COMPRESSION) != "none" {
+		return compress(delta)
+	}
+	var buf = new(bytes.Buffer)
+	w, err := CODECS["zlib"].NewWriter(buf, zlib.DefaultCompression)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(delta)
+	w.Close()
+	return buf
+}
+
+func decompress(r io.Reader) []byte {
+	decompressed, err := newDecompressor(r)
+	if err != nil {
+		panic(err)
+	}
+	var buf = new(bytes.Buffer)
+	buf.ReadFrom(decompressed)
+	decompressed.Close()
+	return buf.Bytes()
+}
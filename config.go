@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const CONFIG_PATH = SHIT_PATH + "/config"
+
+// Repository config, stored as one "key = value" pair per line. Lines starting
+// with # are comments.
+type Config map[string]string
+
+// Config of the current repository, loaded once per invocation
+var config Config
+
+func resetConfig() {
+	config = nil
+}
+
+func getConfig() Config {
+	if config != nil {
+		return config
+	}
+	config = Config{}
+	configFile, err := os.ReadFile(CONFIG_PATH)
+	if os.IsNotExist(err) {
+		return config
+	}
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range strings.Split(string(configFile), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			panic(fmt.Sprintf("Malformed config line %q", line))
+		}
+		config[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return config
+}
+
+func (config Config) Get(key string, defaultValue string) string {
+	if value, found := config[strings.ToLower(key)]; found {
+		return value
+	}
+	return defaultValue
+}
+
+func (config Config) GetBool(key string, defaultValue bool) bool {
+	value, found := config[strings.ToLower(key)]
+	if !found {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		panic(fmt.Sprintf("Config %s must be true or false, was %q", key, value))
+	}
+	return parsed
+}
+
+func (config Config) GetInt(key string, defaultValue int64) int64 {
+	value, found := config[strings.ToLower(key)]
+	if !found {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("Config %s must be an integer, was %q", key, value))
+	}
+	return parsed
+}
+
+func setConfig(key string, value string) {
+	config := getConfig()
+	config[strings.ToLower(key)] = value
+
+	keys := []string{}
+	for key := range config {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	buf := new(bytes.Buffer)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s = %s\n", key, config[key])
+	}
+	writeFile(CONFIG_PATH, buf)
+}
+
+func cmdConfig(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		exitUsage()
+	}
+	if len(args) == 2 {
+		if err := checkConfigChange(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		setConfig(args[0], args[1])
+		return
+	}
+	if value, found := getConfig()[strings.ToLower(args[0])]; found {
+		fmt.Println(value)
+	}
+}
+
+// Returns an error if a config value can't be changed in an existing
+// repository, or would make writing objects fail
+func checkConfigChange(key string, value string) error {
+	config := getConfig()
+	switch strings.ToLower(key) {
+	case "core.objectformat":
+		if value != objectFormat() {
+			return fmt.Errorf("core.objectFormat can only be set by shit init, the existing objects use %s hashes.", objectFormat())
+		}
+	case "core.compression":
+		return checkCompression(value, int(config.GetInt("core.compressionLevel", zlib.DefaultCompression)))
+	case "core.compressionlevel":
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("core.compressionLevel must be an integer, was %q.", value)
+		}
+		return checkCompression(config.Get("core.compression", DEFAULT_COMPRESSION), level)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const DEFAULT_EDITOR = "vi"
+
+// File that flush messages are edited in
+const FLUSH_EDITMSG_PATH = SHIT_PATH + "/FLUSH_EDITMSG"
+
+// Opens a file in $SHIT_EDITOR, $EDITOR or vi and waits for the editor to
+// exit. The editor is run by the shell, so it may include arguments such as
+// "code --wait". Exits with status 1 if the editor fails.
+func editFile(path string) {
+	editor := os.Getenv("SHIT_EDITOR")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = DEFAULT_EDITOR
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		fmt.Printf("The editor %s failed: %s\n", editor, err)
+		os.Exit(1)
+	}
+}
+
+// Lets the user edit a flush message, with the comment appended as lines
+// starting with #. Returns the edited message without comments, which is empty
+// if the user wants to abort.
+func editMessage(message string, comment string) string {
+	buf := bytes.NewBufferString(message + "\n")
+	if message != "" {
+		buf.WriteString("\n")
+	}
+	for _, line := range strings.Split(comment, "\n") {
+		buf.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+	}
+	writeFile(FLUSH_EDITMSG_PATH, buf)
+	editFile(FLUSH_EDITMSG_PATH)
+	return stripComments(readFile(FLUSH_EDITMSG_PATH))
+}
+
+// Removes lines starting with # and surrounding blank lines
+func stripComments(text string) string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// Lets the user write the message of a flush of the bowl, with the staged
+// changes listed as comments. The message starts out as the file set in the
+// flush.template config. Returns an empty message if the user wants to abort,
+// or left the template unchanged.
+func editFlushMessage() string {
+	template := ""
+	if path := getConfig().Get("flush.template", ""); path != "" {
+		template = readMessageFile(path)
+	}
+	comment := "Please enter the flush message for your changes. Lines starting\nwith '#' are ignored, and an empty message aborts the flush.\n\nChanges to be flushed:"
+	for _, change := range stagedChanges(getBowl()) {
+		status := "modified:  "
+		if change.OldHash == "" {
+			status = "new file:  "
+		} else if change.NewHash == "" {
+			status = "deleted:   "
+		}
+		comment += "\n\t" + status + quotePath(change.Path)
+	}
+	message := editMessage(template, comment)
+	if message == stripComments(template) {
+		return ""
+	}
+	return message
+}
+
+// Reads a flush message from a file, or from stdin if the path is -
+func readMessageFile(path string) string {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		fmt.Println("Could not read the flush message: " + err.Error())
+		os.Exit(1)
+	}
+	return strings.TrimRight(string(content), " \t\r\n")
+}
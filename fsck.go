@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+type FsckReport struct {
+	Errors   []string
+	Missing  []string
+	Dangling []string
+}
+
+// A reference from one object, ref or bowl entry to an object
+type fsckLink struct {
+	From       string
+	Hash       string
+	ObjectType string // Expected type, empty if any type is allowed
+}
+
+// Checks the integrity of the repository and exits with status 1 if any
+// object is corrupt or missing
+func cmdFsck() {
+	report := fsck()
+	for _, line := range report.Errors {
+		fmt.Println("error: " + line)
+	}
+	for _, line := range report.Missing {
+		fmt.Println("missing " + line)
+	}
+	for _, line := range report.Dangling {
+		fmt.Println("dangling " + line)
+	}
+	if len(report.Errors) > 0 || len(report.Missing) > 0 {
+		os.Exit(1)
+	}
+}
+
+// Re-hashes every loose and packed object, validates headers, trees and
+// flushes, and checks that every referenced object exists. Objects that are
+// neither referenced by another object nor by a ref, the bowl or a reflog are
+// reported as dangling.
+func fsck() FsckReport {
+	report := FsckReport{}
+
+	hashes := listLooseObjects()
+	for _, pack := range getPacks() {
+		hashes = append(hashes, pack.hashes()...)
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+	stored := make(map[string]bool, len(hashes))
+	for _, name := range hashes {
+		stored[name] = true
+	}
+
+	objectTypes := make(map[string]string)
+	links := []fsckLink{}
+
+	for _, name := range hashes {
+		objectBytes, err := tryReadObject(name)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: unreadable object: %s", name, err))
+			continue
+		}
+		if actual := hash(objectBytes); actual != name {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: hash mismatch, content hashes to %s", name, actual))
+			continue
+		}
+
+		objectType, content, err := parseObjectBytes(objectBytes)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		objectTypes[name] = objectType
+
+		var objectLinks []fsckLink
+		switch objectType {
+		case "tree":
+			objectLinks, err = fsckTree(name, content)
+		case "flush":
+			objectLinks, err = fsckFlush(name, content)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", name, err))
+		}
+		links = append(links, objectLinks...)
+	}
+
+	roots := []fsckLink{}
+	for _, ref := range listRefs() {
+		roots = append(roots, fsckLink{From: "ref " + ref, Hash: readRef(ref), ObjectType: "flush"})
+	}
+	for _, entry := range getBowl() {
+		roots = append(roots, fsckLink{From: "bowl entry " + quotePath(entry.Path), Hash: entry.Hash, ObjectType: "file"})
+	}
+	for _, ref := range listReflogs() {
+		for _, entry := range readReflog(ref) {
+			for _, hash := range []string{entry.OldHash, entry.NewHash} {
+				if strings.Trim(hash, "0") != "" {
+					roots = append(roots, fsckLink{From: "reflog " + ref, Hash: hash, ObjectType: "flush"})
+				}
+			}
+		}
+	}
+
+	referenced := make(map[string]bool)
+	missing := make(map[string]bool)
+	for _, link := range append(links, roots...) {
+		referenced[link.Hash] = true
+		actualType, found := objectTypes[link.Hash]
+		if !found {
+			if stored[link.Hash] {
+				continue // Corrupt, already reported
+			}
+			if !missing[link.Hash] {
+				missing[link.Hash] = true
+				report.Missing = append(report.Missing, fmt.Sprintf("%s %s (referenced by %s)", typeOrObject(link.ObjectType), link.Hash, link.From))
+			}
+			continue
+		}
+		if link.ObjectType != "" && actualType != link.ObjectType {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s references %s %s, which is a %s", link.From, link.ObjectType, link.Hash, actualType))
+		}
+	}
+
+	for _, hash := range hashes {
+		objectType, valid := objectTypes[hash]
+		if valid && !referenced[hash] {
+			report.Dangling = append(report.Dangling, objectType+" "+hash)
+		}
+	}
+	return report
+}
+
+func typeOrObject(objectType string) string {
+	if objectType == "" {
+		return "object"
+	}
+	return objectType
+}
+
+// Reads the raw bytes of an object, returning an error instead of panicking
+// if the object is missing or cannot be decompressed
+func tryReadObject(hash string) (objectBytes []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	reader, _ := openStoredObject(hash)
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Splits raw object bytes into the object type and content, validating the
+// header written by addHeader
+func parseObjectBytes(objectBytes []byte) (string, string, error) {
+	objectType, content, found := strings.Cut(string(objectBytes), "\n\n")
+	if !found || strings.Contains(objectType, "\n") {
+		return "", "", fmt.Errorf("malformed header")
+	}
+	if objectType != "file" && objectType != "tree" && objectType != "flush" {
+		return "", "", fmt.Errorf("unknown object type %q", objectType)
+	}
+	return objectType, content, nil
+}
+
+func fsckTree(hash string, content string) (links []fsckLink, err error) {
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return links, fmt.Errorf("malformed tree entry %q", line)
+		}
+		nodeType, nodeHash := parts[0], parts[1]
+		if nodeType != "file" && nodeType != "exec" && nodeType != "tree" {
+			return links, fmt.Errorf("tree entry %q has unknown type %q", line, nodeType)
+		}
+		if !isObjectName(nodeHash) {
+			return links, fmt.Errorf("tree entry %q has an invalid hash", line)
+		}
+		if !validQuotedPath(parts[2]) {
+			return links, fmt.Errorf("tree entry %q has a malformed name", line)
+		}
+		objectType := nodeType
+		if nodeType == "exec" {
+			objectType = "file"
+		}
+		links = append(links, fsckLink{From: "tree " + hash, Hash: nodeHash, ObjectType: objectType})
+	}
+	return links, nil
+}
+
+func fsckFlush(hash string, content string) (links []fsckLink, err error) {
+	headers, _, found := strings.Cut(content, "\n\n")
+	lines := strings.Split(headers, "\n")
+	if !found || len(lines) < 3 {
+		return links, fmt.Errorf("malformed flush")
+	}
+	treeHash, hasTree := strings.CutPrefix(lines[0], "tree ")
+	parentHash, hasParent := strings.CutPrefix(lines[1], "parent ")
+	_, hasTime := strings.CutPrefix(lines[2], "time ")
+	if !hasTree || !hasParent || !hasTime {
+		return links, fmt.Errorf("malformed flush")
+	}
+	// Optional headers follow the required ones
+	for _, line := range lines[3:] {
+		if !strings.HasPrefix(line, "author ") {
+			return links, fmt.Errorf("flush has an unknown header %q", line)
+		}
+	}
+	if !isObjectName(treeHash) {
+		return links, fmt.Errorf("flush has an invalid tree hash %q", treeHash)
+	}
+	links = append(links, fsckLink{From: "flush " + hash, Hash: treeHash, ObjectType: "tree"})
+	if parentHash != "" {
+		if !isObjectName(parentHash) {
+			return links, fmt.Errorf("flush has an invalid parent hash %q", parentHash)
+		}
+		links = append(links, fsckLink{From: "flush " + hash, Hash: parentHash, ObjectType: "flush"})
+	}
+	return links, nil
+}
+
+func validQuotedPath(path string) (valid bool) {
+	defer func() {
+		if recover() != nil {
+			valid = false
+		}
+	}()
+	unquotePath(path)
+	return true
+}
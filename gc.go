@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Unreachable objects younger than this are kept, since they may belong to
+// an operation that is still in progress
+const DEFAULT_PRUNE_EXPIRE = 14 * 24 * time.Hour
+
+type PruneOptions struct {
+	DryRun bool
+	Expire time.Duration
+}
+
+func parsePruneArgs(args []string) PruneOptions {
+	options := PruneOptions{Expire: DEFAULT_PRUNE_EXPIRE}
+	for _, arg := range args {
+		if arg == "--dry-run" {
+			options.DryRun = true
+		} else if expire, found := strings.CutPrefix(arg, "--expire="); found {
+			if expire == "now" {
+				options.Expire = 0
+				continue
+			}
+			duration, err := time.ParseDuration(expire)
+			if err != nil {
+				fmt.Printf("Invalid expiry %s, expected a duration such as 336h or \"now\".\n", expire)
+				exitUsage()
+			}
+			options.Expire = duration
+		} else {
+			exitUsage()
+		}
+	}
+	return options
+}
+
+func (options PruneOptions) isExpired(modTime time.Time) bool {
+	return time.Since(modTime) >= options.Expire
+}
+
+// Removes unreachable loose objects older than the expiry
+func cmdPrune(args []string) {
+	options := parsePruneArgs(args)
+	pruneLooseObjects(reachableObjects(), options)
+}
+
+// Prunes unreachable objects and repacks the remaining objects into a single
+// pack. Unreachable packed objects are dropped if their pack has expired,
+// otherwise they are written out as loose objects so that they are subject to
+// the expiry of loose objects.
+func cmdGc(args []string) {
+	options := parsePruneArgs(args)
+	reachable := reachableObjects()
+	pruneLooseObjects(reachable, options)
+
+	oldPacks := getPacks()
+	for _, pack := range oldPacks {
+		info, err := os.Stat(pack.Path)
+		if err != nil {
+			panic(err)
+		}
+		for _, hash := range pack.hashes() {
+			if reachable[hash] {
+				continue
+			}
+			if !options.isExpired(info.ModTime()) {
+				if !options.DryRun {
+					explodeObject(hash)
+				}
+			} else if options.DryRun {
+				fmt.Println("Would prune " + hash)
+			} else {
+				fmt.Println("Pruned " + hash)
+			}
+		}
+	}
+	if options.DryRun {
+		return
+	}
+
+	loose := []string{}
+	for _, hash := range listLooseObjects() {
+		if reachable[hash] {
+			loose = append(loose, hash)
+		}
+	}
+	hashes := slices.Clone(loose)
+	for _, pack := range oldPacks {
+		for _, hash := range pack.hashes() {
+			if reachable[hash] {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	packPath := ""
+	deltas := 0
+	if len(hashes) > 0 {
+		packPath, deltas = writePack(hashes)
+	}
+	for _, pack := range oldPacks {
+		if pack.Path == packPath {
+			// Repacking the same objects produces a pack with the same name
+			continue
+		}
+		removePack(pack)
+	}
+	for _, hash := range loose {
+		removeLooseObject(hash)
+	}
+
+	if len(hashes) == 0 {
+		fmt.Println("Nothing to pack")
+		return
+	}
+	fmt.Printf("Packed %d objects (%d deltas)\n", len(hashes), deltas)
+}
+
+func pruneLooseObjects(reachable map[string]bool, options PruneOptions) {
+	for _, hash := range listLooseObjects() {
+		if reachable[hash] {
+			continue
+		}
+		info, err := os.Stat(findObjectPath(hash))
+		if err != nil {
+			panic(err)
+		}
+		if !options.isExpired(info.ModTime()) {
+			continue
+		}
+		if options.DryRun {
+			fmt.Println("Would prune " + hash)
+			continue
+		}
+		removeLooseObject(hash)
+		fmt.Println("Pruned " + hash)
+	}
+}
+
+// Writes a packed object out as a loose object
+func explodeObject(hash string) {
+	if _, err := os.Stat(findObjectPath(hash)); err == nil {
+		return
+	}
+	header, reader := openObject(hash)
+	defer reader.Close()
+	writeObjectFromReader(header.ObjectType, reader, true)
+}
+
+// Marks all objects reachable from the refs, HEAD, the bowl and the reflogs
+func reachableObjects() map[string]bool {
+	reachable := make(map[string]bool)
+
+	roots := []string{}
+	for _, ref := range listRefs() {
+		roots = append(roots, readRef(ref))
+	}
+	if head := getHead(); head != nil {
+		roots = append(roots, head.Object.Hash)
+	}
+	for _, entry := range getBowl() {
+		roots = append(roots, entry.Hash)
+	}
+	for _, ref := range listReflogs() {
+		for _, entry := range readReflog(ref) {
+			roots = append(roots, entry.OldHash, entry.NewHash)
+		}
+	}
+
+	for _, root := range roots {
+		markReachable(root, reachable)
+	}
+	return reachable
+}
+
+func markReachable(hash string, reachable map[string]bool) {
+	// Flush parents are followed in a loop rather than by recursion, since
+	// the history can be arbitrarily long
+	for hash != "" && !reachable[hash] && isObjectName(hash) && objectExists(hash) {
+		reachable[hash] = true
+		header, reader := openObject(hash)
+		reader.Close()
+
+		switch header.ObjectType {
+		case "flush":
+			flush := getFlush(hash)
+			markReachable(flush.TreeHash, reachable)
+			hash = flush.ParentHash
+		case "tree":
+			for _, node := range getObject(hash).ToTree().Nodes {
+				markReachable(node.Hash, reachable)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/emanueldonalds/shit
 
 go 1.22.2
+
+require github.com/klauspost/compress v1.17.11
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Executables in this directory are run before and after flushing and
+// plunging. Hooks run in the workdir with SHIT_DIR set to the absolute path of
+// .shit and SHIT_HOOK set to the hook name. A pre-flush, flush-msg or
+// pre-plunge hook that exits with a non-zero status aborts the operation. The
+// pre-flush, flush-msg and pre-plunge hooks run with the bowl locked, so they
+// can't add files to it. The pre-plunge hook only runs once plunging has been
+// checked for conflicts.
+//
+//	pre-flush    no arguments, the staged changes on stdin
+//	flush-msg    the path of a file with the flush message, which it may edit
+//	post-flush   the hash of the new flush
+//	pre-plunge   the HEAD hash and the hash to plunge, the changes on stdin
+//	post-plunge  the HEAD hash and the plunged hash
+//
+// Changes are written as "<A|M|D>\t<path>" lines.
+const HOOKS_PATH = SHIT_PATH + "/hooks"
+
+// Runs a hook if it exists. Returns false if the hook failed.
+func runHook(name string, args []string, stdin io.Reader) bool {
+	path := filepath.Join(HOOKS_PATH, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	if !isExecutable(info.Mode()) {
+		fmt.Printf("The %s hook was ignored because it is not executable.\n", name)
+		return true
+	}
+
+	shitDir, err := filepath.Abs(SHIT_PATH)
+	if err != nil {
+		panic(err)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "SHIT_DIR="+shitDir, "SHIT_HOOK="+name)
+	if stdin == nil {
+		stdin = bytes.NewReader(nil)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run() == nil
+}
+
+// Runs a pre-hook while holding a lock, and releases the lock and exits with
+// status 1 if the hook fails
+func runPreHook(lock *LockFile, name string, operation string, args []string, stdin io.Reader) {
+	if !runHook(name, args, stdin) {
+		lock.Release()
+		fmt.Printf("The %s hook failed, aborting the %s.\n", name, operation)
+		os.Exit(1)
+	}
+}
+
+// Lists changes as the hooks read them on stdin
+func hookChanges(changes []PlungeChange) io.Reader {
+	buf := bytes.NewBufferString("")
+	for _, change := range changes {
+		buf.WriteString(changeStatus(change) + "\t" + quotePath(change.Path) + "\n")
+	}
+	return buf
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a lock held by another process before giving up,
+// configurable in milliseconds with core.lockTimeout
+const DEFAULT_LOCK_TIMEOUT = 10 * time.Second
+
+// Locks older than this are considered stale even if their owner can't be
+// checked, e.g. because it runs on another host
+const STALE_LOCK_AGE = time.Hour
+
+const LOCK_RETRY_INTERVAL = 50 * time.Millisecond
+
+// A lock file guards updates of a file against concurrent writers. It is
+// created exclusively next to the locked file and holds the pid and hostname
+// of its owner until committed. Committing writes the new content to the lock
+// file and renames it over the locked file.
+type LockFile struct {
+	Path      string // Path of the locked file
+	file      *os.File
+	committed bool
+}
+
+type LockError struct {
+	Path  string
+	Owner string
+}
+
+func (err *LockError) Error() string {
+	return fmt.Sprintf("Unable to lock %s, it is locked by %s. If no other shit process is running, remove %s.lock and try again.", err.Path, err.Owner, err.Path)
+}
+
+// Locks a file, waiting up to core.lockTimeout for a lock held by another
+// process to be released. Stale locks left behind by processes that have died
+// are removed.
+func acquireLock(path string) (*LockFile, error) {
+	timeout := time.Duration(getConfig().GetInt("core.lockTimeout", DEFAULT_LOCK_TIMEOUT.Milliseconds())) * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, owner, err := tryLock(path)
+		if lock != nil || err != nil {
+			return lock, err
+		}
+		if removeStaleLock(path) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, &LockError{Path: path, Owner: owner}
+		}
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+}
+
+// Tries to create the lock file once. Returns the owner of the existing lock
+// if the file is already locked.
+func tryLock(path string) (*LockFile, string, error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, lockOwner(path), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = file.WriteString(currentLockOwner())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	return &LockFile{Path: path, file: file}, "", nil
+}
+
+func currentLockOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%d %s", os.Getpid(), hostname)
+}
+
+func lockOwner(path string) string {
+	owner, err := os.ReadFile(path + ".lock")
+	if err != nil || len(owner) == 0 {
+		return "an unknown process"
+	}
+	pid, hostname, _ := strings.Cut(string(owner), " ")
+	return fmt.Sprintf("process %s on %s", pid, hostname)
+}
+
+// Removes the lock file if its owner has died. The age of the lock is only
+// used if the owner can't be checked, because it runs on another host or the
+// lock file is unreadable. Returns true if a stale lock was removed.
+func removeStaleLock(path string) bool {
+	lockPath := path + ".lock"
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		return os.IsNotExist(err) // Released in the meantime
+	}
+	owner, err := os.ReadFile(lockPath)
+	if err != nil {
+		return false
+	}
+
+	stale := time.Since(info.ModTime()) > STALE_LOCK_AGE
+	pidStr, lockHostname, _ := strings.Cut(string(owner), " ")
+	pid, err := strconv.Atoi(pidStr)
+	hostname, _ := os.Hostname()
+	if err == nil && lockHostname == hostname {
+		stale = !processExists(pid)
+	}
+	if !stale {
+		return false
+	}
+
+	// Make sure the lock was not replaced by a live one since it was checked
+	current, err := os.ReadFile(lockPath)
+	if err != nil || !bytes.Equal(current, owner) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Removing stale lock %s\n", lockPath)
+	return os.Remove(lockPath) == nil
+}
+
+// Exits with an error message if the file can't be locked
+func mustLock(path string) *LockFile {
+	lock, err := acquireLock(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return lock
+}
+
+// Locks the bowl for a read-modify-write cycle. The lock must be held from
+// before the bowl is read until it is written with writeBowl.
+func lockBowl() *LockFile {
+	return mustLock(BOWL_PATH)
+}
+
+// Atomically replaces the locked file with the content and releases the lock.
+// Exits with status 1 if the lock was taken over by another process.
+func (lock *LockFile) Commit(buf *bytes.Buffer) {
+	if !lock.owned() {
+		lock.file.Close()
+		lock.committed = true
+		fmt.Printf("The lock on %s was removed by another process, %s was not written.\n", lock.Path, lock.Path)
+		os.Exit(1)
+	}
+	_, err := lock.file.Seek(0, io.SeekStart)
+	if err != nil {
+		panic(err)
+	}
+	err = lock.file.Truncate(0)
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.Copy(lock.file, buf)
+	if err != nil {
+		panic(err)
+	}
+	commitFile(lock.file, lock.Path, 0644)
+	lock.committed = true
+}
+
+// Releases the lock without changing the locked file. Does nothing if the
+// lock has been committed.
+func (lock *LockFile) Release() {
+	if lock.committed {
+		return
+	}
+	if lock.owned() {
+		os.Remove(lock.file.Name())
+	}
+	lock.file.Close()
+	lock.committed = true
+}
+
+// Returns false if the lock file has been removed, and possibly replaced by
+// the lock of another process, since the lock was taken
+func (lock *LockFile) owned() bool {
+	info, err := lock.file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(lock.file.Name())
+	return err == nil && os.SameFile(info, current)
+}
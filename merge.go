@@ -0,0 +1,204 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// A region of lines [AStart, AEnd) of one version that was replaced by the
+// lines [BStart, BEnd) of another. Either range may be empty.
+type DiffHunk struct {
+	AStart, AEnd int
+	BStart, BEnd int
+}
+
+// Splits text into lines, keeping the line endings so that joining the lines
+// gives back the text
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Computes the hunks that turn the lines a into the lines b. Lines shared at
+// the start and end are skipped before diffing the rest with the O(ND)
+// algorithm by Myers.
+func diffLines(a []string, b []string) []DiffHunk {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	hunks := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	for i := range hunks {
+		hunks[i].AStart += prefix
+		hunks[i].AEnd += prefix
+		hunks[i].BStart += prefix
+		hunks[i].BEnd += prefix
+	}
+	return hunks
+}
+
+func myersDiff(a []string, b []string) []DiffHunk {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// The furthest x reached on each diagonal k before each step d, indexed
+	// by k+d+1
+	trace := [][]int{}
+
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v[offset-d-1:offset+d+2]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Insertion
+			} else {
+				x = v[offset+k-1] + 1 // Deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace backwards, collecting the lines that both versions share
+	type match struct{ a, b int }
+	matches := []match{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[k-1+d+1] < v[k+1+d+1]) {
+			prevK = k + 1
+		}
+		prevX := v[prevK+d+1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches = append(matches, match{x, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		matches = append(matches, match{x, y})
+	}
+	slices.Reverse(matches)
+
+	hunks := []DiffHunk{}
+	aPos, bPos := 0, 0
+	for _, match := range append(matches, match{n, m}) {
+		if match.a > aPos || match.b > bPos {
+			hunks = append(hunks, DiffHunk{AStart: aPos, AEnd: match.a, BStart: bPos, BEnd: match.b})
+		}
+		aPos, bPos = match.a+1, match.b+1
+	}
+	return hunks
+}
+
+// Merges the changes from base to ours and from base to theirs line by line.
+// Changes to overlapping or adjacent lines that differ are conflicts, which
+// are written with conflict markers labelled with the names of the versions.
+// Returns the merged text and whether there were any conflicts.
+func merge3(base string, ours string, theirs string, oursLabel string, theirsLabel string) (string, bool) {
+	baseLines, oursLines, theirsLines := splitLines(base), splitLines(ours), splitLines(theirs)
+	oursHunks := diffLines(baseLines, oursLines)
+	theirsHunks := diffLines(baseLines, theirsLines)
+
+	var merged strings.Builder
+	conflicts := false
+	basePos := 0
+	oursOffset, theirsOffset := 0, 0 // Line offsets of the versions relative to base
+	i, j := 0, 0
+	for i < len(oursHunks) || j < len(theirsHunks) {
+		// Start a region at the earliest hunk and grow it while hunks of
+		// either version overlap it
+		var start, end int
+		if j == len(theirsHunks) || (i < len(oursHunks) && oursHunks[i].AStart <= theirsHunks[j].AStart) {
+			start, end = oursHunks[i].AStart, oursHunks[i].AEnd
+		} else {
+			start, end = theirsHunks[j].AStart, theirsHunks[j].AEnd
+		}
+		oursEnd, theirsEnd := i, j
+		for {
+			if oursEnd < len(oursHunks) && oursHunks[oursEnd].AStart <= end {
+				end = max(end, oursHunks[oursEnd].AEnd)
+				oursEnd++
+			} else if theirsEnd < len(theirsHunks) && theirsHunks[theirsEnd].AStart <= end {
+				end = max(end, theirsHunks[theirsEnd].AEnd)
+				theirsEnd++
+			} else {
+				break
+			}
+		}
+
+		for _, line := range baseLines[basePos:start] {
+			merged.WriteString(line)
+		}
+		oursRegion, oursDelta := regionLines(oursLines, oursHunks[i:oursEnd], start, end, oursOffset)
+		theirsRegion, theirsDelta := regionLines(theirsLines, theirsHunks[j:theirsEnd], start, end, theirsOffset)
+		if oursEnd == i {
+			writeLines(&merged, theirsRegion)
+		} else if theirsEnd == j || slices.Equal(oursRegion, theirsRegion) {
+			writeLines(&merged, oursRegion)
+		} else {
+			conflicts = true
+			merged.WriteString("<<<<<<< " + oursLabel + "\n")
+			writeLines(&merged, oursRegion)
+			endLine(&merged)
+			merged.WriteString("=======\n")
+			writeLines(&merged, theirsRegion)
+			endLine(&merged)
+			merged.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+
+		basePos = end
+		oursOffset += oursDelta
+		theirsOffset += theirsDelta
+		i, j = oursEnd, theirsEnd
+	}
+	for _, line := range baseLines[basePos:] {
+		merged.WriteString(line)
+	}
+	return merged.String(), conflicts
+}
+
+// Returns the lines of a version that replace the base lines [start, end),
+// and by how many lines the hunks in the region change the length
+func regionLines(lines []string, hunks []DiffHunk, start int, end int, offset int) ([]string, int) {
+	delta := 0
+	for _, hunk := range hunks {
+		delta += (hunk.BEnd - hunk.BStart) - (hunk.AEnd - hunk.AStart)
+	}
+	return lines[start+offset : end+offset+delta], delta
+}
+
+func writeLines(builder *strings.Builder, lines []string) {
+	for _, line := range lines {
+		builder.WriteString(line)
+	}
+}
+
+// Terminates the last line so that a conflict marker starts on its own line
+func endLine(builder *strings.Builder) {
+	if builder.Len() > 0 && !strings.HasSuffix(builder.String(), "\n") {
+		builder.WriteString("\n")
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const PACK_PATH = OBJECTS_PATH + "/pack"
+
+const PACK_MAGIC = "SPCK"
+const PACK_INDEX_MAGIC = "SIDX"
+const PACK_VERSION = 1
+
+// Pack entry kinds
+const PACK_FULL = 0
+const PACK_DELTA = 1
+
+// Only objects up to this uncompressed size are loaded into memory to be delta
+// compressed, larger objects are streamed into the pack as is.
+const PACK_DELTA_MAX_SIZE = 16 * 1024 * 1024
+
+// Number of preceding objects of the same type tried as delta bases
+const PACK_DELTA_WINDOW = 10
+
+// Maximum length of a delta chain, bounding the work needed to read an object
+const PACK_DELTA_MAX_DEPTH = 10
+
+// A pack stores many objects in a single file, with an index for looking up
+// objects by hash. The pack file layout is:
+//
+//	magic "SPCK" | version uint32 | object count uint32
+//
+// followed by one entry per object:
+//
+//	kind uint8 | base offset uint64 (delta entries only) | data length uint64 | data
+//
+// Full entries hold the compressed object bytes. Delta entries hold compressed
+// delta instructions against the entry at the base offset, which always
+// precedes the delta in the pack. Deltas are compressed even with the none
+// codec, as they can't be told apart from compressed data otherwise. The
+// index file layout is:
+//
+//	magic "SIDX" | version uint32 | object count uint32 | hash length uint8
+//
+// followed by one record per object, sorted by hash:
+//
+//	hash | pack offset uint64
+//
+// All integers are big endian, hashes are stored as raw bytes.
+type Pack struct {
+	Path    string
+	Index   []byte // Index records
+	Count   int
+	HashLen int
+}
+
+// Packs found in the repository, loaded once per invocation
+var packs []*Pack
+var packsLoaded bool
+
+func resetPacks() {
+	packs = nil
+	packsLoaded = false
+}
+
+func getPacks() []*Pack {
+	if packsLoaded {
+		return packs
+	}
+	indexPaths, err := filepath.Glob(filepath.Join(PACK_PATH, "pack-*.idx"))
+	if err != nil {
+		panic(err)
+	}
+	for _, indexPath := range indexPaths {
+		packs = append(packs, readPackIndex(indexPath))
+	}
+	packsLoaded = true
+	return packs
+}
+
+func readPackIndex(indexPath string) *Pack {
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		panic(err)
+	}
+	headerLen := len(PACK_INDEX_MAGIC) + 4 + 4 + 1
+	if len(index) < headerLen || string(index[:len(PACK_INDEX_MAGIC)]) != PACK_INDEX_MAGIC {
+		panic(fmt.Sprintf("Pack index %s is corrupt", indexPath))
+	}
+	version := binary.BigEndian.Uint32(index[4:8])
+	if version != PACK_VERSION {
+		panic(fmt.Sprintf("Unsupported pack index version %d in %s", version, indexPath))
+	}
+	count := int(binary.BigEndian.Uint32(index[8:12]))
+	hashLen := int(index[12])
+	records := index[headerLen:]
+	if len(records) != count*(hashLen+8) {
+		panic(fmt.Sprintf("Pack index %s is corrupt", indexPath))
+	}
+
+	if hashLen != newHasher().Size() {
+		panic(fmt.Sprintf("Pack index %s uses %d byte hashes, expected %s hashes", indexPath, hashLen, objectFormat()))
+	}
+
+	packPath := strings.TrimSuffix(indexPath, ".idx") + ".pack"
+	return &Pack{Path: packPath, Index: records, Count: count, HashLen: hashLen}
+}
+
+func findPackedObject(hash string) (*Pack, int64, bool) {
+	for _, pack := range getPacks() {
+		if offset, found := pack.find(hash); found {
+			return pack, offset, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (pack *Pack) record(i int) ([]byte, int64) {
+	recordLen := pack.HashLen + 8
+	record := pack.Index[i*recordLen : (i+1)*recordLen]
+	return record[:pack.HashLen], int64(binary.BigEndian.Uint64(record[pack.HashLen:]))
+}
+
+// Binary searches the index for an object
+func (pack *Pack) find(hash string) (int64, bool) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil || len(hashBytes) != pack.HashLen {
+		return 0, false
+	}
+	i := sort.Search(pack.Count, func(i int) bool {
+		recordHash, _ := pack.record(i)
+		return bytes.Compare(recordHash, hashBytes) >= 0
+	})
+	if i == pack.Count {
+		return 0, false
+	}
+	recordHash, offset := pack.record(i)
+	if !bytes.Equal(recordHash, hashBytes) {
+		return 0, false
+	}
+	return offset, true
+}
+
+// Hashes of all objects in the pack, in index order
+func (pack *Pack) hashes() []string {
+	hashes := []string{}
+	for i := 0; i < pack.Count; i++ {
+		hash, _ := pack.record(i)
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+	return hashes
+}
+
+type packEntry struct {
+	Kind       uint8
+	BaseOffset int64
+	DataOffset int64
+	DataLen    int64
+}
+
+func readPackEntry(file *os.File, offset int64) packEntry {
+	header := make([]byte, 1+8+8)
+	n, err := file.ReadAt(header, offset)
+	if err != nil && !(err == io.EOF && n >= 9) {
+		panic(fmt.Sprintf("Pack %s is corrupt at offset %d: %s", file.Name(), offset, err))
+	}
+	entry := packEntry{Kind: header[0]}
+	switch entry.Kind {
+	case PACK_FULL:
+		entry.DataLen = int64(binary.BigEndian.Uint64(header[1:9]))
+		entry.DataOffset = offset + 9
+	case PACK_DELTA:
+		entry.BaseOffset = int64(binary.BigEndian.Uint64(header[1:9]))
+		entry.DataLen = int64(binary.BigEndian.Uint64(header[9:17]))
+		entry.DataOffset = offset + 17
+	default:
+		panic(fmt.Sprintf("Pack %s has an unknown entry kind %d at offset %d", file.Name(), entry.Kind, offset))
+	}
+	return entry
+}
+
+// Opens the decompressed bytes of the object at offset. Full entries are
+// decompressed lazily, delta entries are resolved in memory.
+func (pack *Pack) openObject(offset int64) io.ReadCloser {
+	file, err := os.Open(pack.Path)
+	if err != nil {
+		panic(err)
+	}
+	entry := readPackEntry(file, offset)
+	if entry.Kind == PACK_DELTA {
+		defer file.Close()
+		return io.NopCloser(bytes.NewReader(pack.readObjectBytes(file, offset)))
+	}
+	decompressed, err := newDecompressor(io.NewSectionReader(file, entry.DataOffset, entry.DataLen))
+	if err != nil {
+		file.Close()
+		panic(err)
+	}
+	return &objectReader{Reader: decompressed, closers: []io.Closer{decompressed, file}}
+}
+
+func (pack *Pack) readObjectBytes(file *os.File, offset int64) []byte {
+	entry := readPackEntry(file, offset)
+	decompressed, err := newDecompressor(io.NewSectionReader(file, entry.DataOffset, entry.DataLen))
+	if err != nil {
+		panic(err)
+	}
+	defer decompressed.Close()
+	data, err := io.ReadAll(decompressed)
+	if err != nil {
+		panic(err)
+	}
+	if entry.Kind == PACK_DELTA {
+		base := pack.readObjectBytes(file, entry.BaseOffset)
+		return applyDelta(base, data)
+	}
+	return data
+}
+
+// Packs all loose objects into a new pack
+func cmdPack() {
+	hashes := listLooseObjects()
+	if len(hashes) == 0 {
+		fmt.Println("Nothing to pack")
+		return
+	}
+	_, deltas := writePack(hashes)
+	for _, hash := range hashes {
+		removeLooseObject(hash)
+	}
+	fmt.Printf("Packed %d objects (%d deltas)\n", len(hashes), deltas)
+}
+
+func removePack(pack *Pack) {
+	err := os.Remove(strings.TrimSuffix(pack.Path, ".pack") + ".idx")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(pack.Path)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type packCandidate struct {
+	Hash       string
+	ObjectType string
+	Size       int64
+}
+
+type packWindowEntry struct {
+	Hash       string
+	ObjectType string
+	Bytes      []byte
+	Offset     int64
+	Depth      int
+}
+
+// Writes the objects to a new pack and returns its path and the number of
+// delta entries.
+// Objects are sorted by type and decreasing size so that similar objects end
+// up close together, and each object is delta compressed against the best of
+// the preceding objects in the window. The index is written after the pack,
+// so a pack only becomes visible to readers once it is complete.
+func writePack(hashes []string) (string, int) {
+	err := os.MkdirAll(PACK_PATH, 0775)
+	if err != nil {
+		panic(err)
+	}
+
+	sorted := slices.Clone(hashes)
+	slices.Sort(sorted)
+	packName := "pack-" + hash([]byte(strings.Join(sorted, "\n")))
+	packPath := filepath.Join(PACK_PATH, packName+".pack")
+
+	var offsets map[string]int64
+	deltas := 0
+	writeTempFile(PACK_PATH, "tmp_pack_", 0644, func(tmp *os.File) string {
+		offsets, deltas = writePackEntries(tmp, packCandidates(hashes))
+		return packPath
+	})
+	writePackIndex(filepath.Join(PACK_PATH, packName+".idx"), sorted, offsets)
+	resetPacks()
+	return packPath, deltas
+}
+
+// Writes the pack header and entries, and returns the offset of each object
+// and the number of delta entries
+func writePackEntries(tmp *os.File, candidates []packCandidate) (map[string]int64, int) {
+	header := new(bytes.Buffer)
+	header.WriteString(PACK_MAGIC)
+	binary.Write(header, binary.BigEndian, uint32(PACK_VERSION))
+	binary.Write(header, binary.BigEndian, uint32(len(candidates)))
+	_, err := tmp.Write(header.Bytes())
+	if err != nil {
+		panic(err)
+	}
+
+	offsets := make(map[string]int64)
+	window := []packWindowEntry{}
+	deltas := 0
+
+	for _, candidate := range candidates {
+		offset, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			panic(err)
+		}
+		offsets[candidate.Hash] = offset
+
+		if candidate.Size > PACK_DELTA_MAX_SIZE {
+			writeFullPackEntry(tmp, candidate.Hash)
+			continue
+		}
+
+		objectBytes := getObject(candidate.Hash).Bytes
+		var bestDelta []byte
+		var bestBase *packWindowEntry
+		for i := range window {
+			base := &window[i]
+			if base.ObjectType != candidate.ObjectType || base.Depth >= PACK_DELTA_MAX_DEPTH {
+				continue
+			}
+			delta := createDelta(base.Bytes, objectBytes)
+			if bestDelta == nil || len(delta) < len(bestDelta) {
+				bestDelta = delta
+				bestBase = base
+			}
+		}
+
+		depth := 0
+		// Only store a delta when it is considerably smaller than the object
+		if bestDelta != nil && len(bestDelta) < len(objectBytes)/2 {
+			writePackEntry(tmp, PACK_DELTA, bestBase.Offset, compressDelta(bestDelta).Bytes())
+			depth = bestBase.Depth + 1
+			deltas++
+		} else {
+			writePackEntry(tmp, PACK_FULL, 0, compress(objectBytes).Bytes())
+		}
+
+		window = append(window, packWindowEntry{Hash: candidate.Hash, ObjectType: candidate.ObjectType, Bytes: objectBytes, Offset: offset, Depth: depth})
+		if len(window) > PACK_DELTA_WINDOW {
+			window = window[1:]
+		}
+	}
+	return offsets, deltas
+}
+
+// Returns the objects to pack with their uncompressed sizes, sorted by type
+// and decreasing size
+func packCandidates(hashes []string) []packCandidate {
+	candidates := []packCandidate{}
+	for _, hash := range hashes {
+		// Objects have no size in their header, so they are streamed to count
+		// their bytes without loading them
+		header, reader := openObject(hash)
+		size, err := io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil {
+			panic(err)
+		}
+		candidates = append(candidates, packCandidate{Hash: hash, ObjectType: header.ObjectType, Size: int64(header.Len) + size})
+	}
+	slices.SortStableFunc(candidates, func(a, b packCandidate) int {
+		if a.ObjectType != b.ObjectType {
+			return strings.Compare(a.ObjectType, b.ObjectType)
+		}
+		return int(b.Size - a.Size)
+	})
+	return candidates
+}
+
+func writePackEntry(w io.Writer, kind uint8, baseOffset int64, data []byte) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(kind)
+	if kind == PACK_DELTA {
+		binary.Write(buf, binary.BigEndian, uint64(baseOffset))
+	}
+	binary.Write(buf, binary.BigEndian, uint64(len(data)))
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Streams an object into the pack as a full entry without loading it into
+// memory. The data length is filled in once the object has been compressed.
+func writeFullPackEntry(file *os.File, hash string) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		panic(err)
+	}
+	writePackEntry(file, PACK_FULL, 0, nil)
+
+	reader := openRawObject(hash)
+	defer reader.Close()
+	compressor := newCompressor(file)
+	_, err = io.Copy(compressor, reader)
+	if err != nil {
+		panic(err)
+	}
+	err = compressor.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	end, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		panic(err)
+	}
+	dataLen := make([]byte, 8)
+	binary.BigEndian.PutUint64(dataLen, uint64(end-offset-9))
+	_, err = file.WriteAt(dataLen, offset+1)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func writePackIndex(indexPath string, sortedHashes []string, offsets map[string]int64) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(PACK_INDEX_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint32(PACK_VERSION))
+	binary.Write(buf, binary.BigEndian, uint32(len(sortedHashes)))
+	hashLen := len(sortedHashes[0]) / 2
+	buf.WriteByte(byte(hashLen))
+	for _, hash := range sortedHashes {
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			panic(err)
+		}
+		buf.Write(hashBytes)
+		binary.Write(buf, binary.BigEndian, uint64(offsets[hash]))
+	}
+	writeFile(indexPath, buf)
+}
+
+// Size of an object as stored on disk, either loose or in a pack
+func storedObjectSize(hash string) int64 {
+	info, err := os.Stat(findObjectPath(hash))
+	if err == nil {
+		return info.Size()
+	}
+	pack, offset, found := findPackedObject(hash)
+	if !found {
+		panic(fmt.Sprintf("Object %s not found", hash))
+	}
+	file, err := os.Open(pack.Path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	return readPackEntry(file, offset).DataLen
+}
+
+// Block size used to find matches between a delta base and its target
+const DELTA_BLOCK_SIZE = 16
+
+// Base offsets indexed per block content. Repetitive data has many equal
+// blocks, and extending a match at each of them would take quadratic time.
+const DELTA_MAX_CANDIDATES = 64
+
+// Delta instructions
+const DELTA_COPY = 0
+const DELTA_INSERT = 1
+
+// Creates a delta that rebuilds target from base. The delta layout is:
+//
+//	base length uvarint | target length uvarint | instructions
+//
+// where each instruction either copies a range of the base or inserts
+// literal bytes:
+//
+//	0 | offset uvarint | length uvarint
+//	1 | length uvarint | bytes
+func createDelta(base []byte, target []byte) []byte {
+	blocks := indexDeltaBlocks(base)
+	delta := binary.AppendUvarint(nil, uint64(len(base)))
+	delta = binary.AppendUvarint(delta, uint64(len(target)))
+	var insert []byte
+
+	flushInsert := func() {
+		if len(insert) > 0 {
+			delta = append(delta, DELTA_INSERT)
+			delta = binary.AppendUvarint(delta, uint64(len(insert)))
+			delta = append(delta, insert...)
+			insert = nil
+		}
+	}
+
+	for i := 0; i < len(target); {
+		bestOffset, bestLen := 0, 0
+		if i+DELTA_BLOCK_SIZE <= len(target) {
+			for _, offset := range blocks[string(target[i:i+DELTA_BLOCK_SIZE])] {
+				matchLen := 0
+				for offset+matchLen < len(base) && i+matchLen < len(target) && base[offset+matchLen] == target[i+matchLen] {
+					matchLen++
+				}
+				if matchLen > bestLen {
+					bestOffset, bestLen = offset, matchLen
+				}
+			}
+		}
+		if bestLen >= DELTA_BLOCK_SIZE {
+			flushInsert()
+			delta = append(delta, DELTA_COPY)
+			delta = binary.AppendUvarint(delta, uint64(bestOffset))
+			delta = binary.AppendUvarint(delta, uint64(bestLen))
+			i += bestLen
+		} else {
+			insert = append(insert, target[i])
+			i++
+		}
+	}
+	flushInsert()
+	return delta
+}
+
+// Indexes the start of every block in a delta base, up to
+// DELTA_MAX_CANDIDATES offsets per block content
+func indexDeltaBlocks(base []byte) map[string][]int {
+	blocks := make(map[string][]int)
+	for i := 0; i+DELTA_BLOCK_SIZE <= len(base); i += DELTA_BLOCK_SIZE {
+		key := string(base[i : i+DELTA_BLOCK_SIZE])
+		if len(blocks[key]) < DELTA_MAX_CANDIDATES {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+	return blocks
+}
+
+func applyDelta(base []byte, delta []byte) []byte {
+	reader := bytes.NewReader(delta)
+	readUvarint := func() int {
+		value, err := binary.ReadUvarint(reader)
+		if err != nil {
+			panic(fmt.Sprintf("Delta is corrupt: %s", err))
+		}
+		return int(value)
+	}
+
+	baseLen := readUvarint()
+	if baseLen != len(base) {
+		panic(fmt.Sprintf("Delta base length %d does not match base of length %d", baseLen, len(base)))
+	}
+	target := make([]byte, 0, readUvarint())
+
+	for reader.Len() > 0 {
+		instruction, _ := reader.ReadByte()
+		switch instruction {
+		case DELTA_COPY:
+			offset := readUvarint()
+			length := readUvarint()
+			if offset+length > len(base) {
+				panic("Delta copies past the end of its base")
+			}
+			target = append(target, base[offset:offset+length]...)
+		case DELTA_INSERT:
+			length := readUvarint()
+			literal := make([]byte, length)
+			if _, err := io.ReadFull(reader, literal); err != nil {
+				panic("Delta inserts past the end of the delta")
+			}
+			target = append(target, literal...)
+		default:
+			panic(fmt.Sprintf("Delta has an unknown instruction %d", instruction))
+		}
+	}
+
+	if len(target) != cap(target) {
+		panic("Delta produced an object of unexpected length")
+	}
+	return target
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The HEAD hash and the hash of the flush that was last plunged out on it
+const PLUNGED_PATH = SHIT_PATH + "/PLUNGED"
+
+type PlungeOptions struct {
+	Force bool // Overwrite local changes
+	Merge bool // Merge local changes with the plunged versions
+}
+
+// A path whose content or mode differs between the current bowl and the
+// plunged tree
+type PlungeChange struct {
+	Path    string
+	OldHash string      // Empty if the path is not in the current bowl
+	NewHash string      // Empty if the path is not in the plunged tree
+	Mode    os.FileMode // Mode of the plunged file
+}
+
+func parsePlungeArgs(args []string) (string, PlungeOptions) {
+	options := PlungeOptions{}
+	hash := ""
+	for _, arg := range args {
+		if arg == "--force" {
+			options.Force = true
+		} else if arg == "--merge" {
+			options.Merge = true
+		} else if hash == "" && !strings.HasPrefix(arg, "--") {
+			hash = arg
+		} else {
+			exitUsage()
+		}
+	}
+	if hash == "" {
+		exitUsage()
+	}
+	if options.Force && options.Merge {
+		fmt.Println("--force and --merge can't be used together.")
+		exitUsage()
+	}
+	return hash, options
+}
+
+// Replaces the bowl and workdir files with the tree of a flush. Only paths
+// whose entries differ between the bowl and the tree are written, deleted or
+// chmodded. Other files keep their local changes and mtimes, so that build
+// tools don't consider them changed. Plunging aborts if it would overwrite
+// staged or local changes or untracked files, unless --force is given, or
+// --merge for local changes.
+func cmdPlunge(args []string) {
+	hash, options := parsePlungeArgs(args)
+	head := getFlush(hash)
+	headHash := strings.Repeat("0", len(head.Object.Hash))
+	if current := getHead(); current != nil {
+		headHash = current.Object.Hash
+	}
+	hookArgs := []string{headHash, head.Object.Hash}
+
+	// The bowl is locked before the pre-plunge hook runs, so that the hook
+	// sees the changes that are applied
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+	currentBowl := getBowl()
+	bowlMtime := getBowlMtime()
+	fmt.Println("Head is " + head.Object.Hash)
+	changes := plungeChanges(currentBowl, getObject(head.TreeHash).ToTree().ToBowl())
+
+	staged := stagedConflicts(currentBowl, plungeBase(), changes)
+	modified, untracked := plungeConflicts(currentBowl, changes, bowlMtime)
+	if !options.Force && (len(staged) > 0 || len(untracked) > 0 || (len(modified) > 0 && !options.Merge)) {
+		bowlLock.Release()
+		if len(staged) > 0 {
+			fmt.Println("Your staged changes to the following files would be overwritten by plunge:")
+			printPaths(staged)
+			fmt.Println("Flush them first, or plunge with --force to discard them.")
+		}
+		if len(modified) > 0 && !options.Merge {
+			fmt.Println("Your local changes to the following files would be overwritten by plunge:")
+			printPaths(modified)
+			fmt.Println("Flush them first, or plunge with --merge to merge them or --force to discard them.")
+		}
+		if len(untracked) > 0 {
+			fmt.Println("The following untracked files would be overwritten by plunge:")
+			printPaths(untracked)
+			fmt.Println("Move or remove them first, or plunge with --force to overwrite them.")
+		}
+		os.Exit(1)
+	}
+	runPreHook(bowlLock, "pre-plunge", "plunge", hookArgs, hookChanges(changes))
+
+	writeBowl(bowlLock, applyPlungeChanges(currentBowl, changes, modified, untracked, options, head.Object.Hash, bowlMtime))
+	writeFile(PLUNGED_PATH, bytes.NewBufferString(headHash+" "+head.Object.Hash))
+	fmt.Println("Plunged out " + head.Object.Hash)
+	runHook("post-plunge", hookArgs, nil)
+}
+
+// Writes the changes to the workdir and returns the new bowl. Modified paths
+// are merged with --merge, and overwritten otherwise. Untracked files and
+// directories in the way are removed with --force before anything else is
+// changed.
+func applyPlungeChanges(currentBowl []BowlEntry, changes []PlungeChange, modified []string, untracked []string, options PlungeOptions, hash string, bowlMtime int64) []BowlEntry {
+	bowlEntries := bowlMap(currentBowl)
+	if options.Force {
+		for _, path := range untracked {
+			err := os.RemoveAll(path)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// Deleted paths are removed first, so that a deleted file can be replaced
+	// by a directory of the same name
+	deleted := []BowlEntry{}
+	for _, change := range changes {
+		if change.NewHash != "" {
+			continue
+		}
+		delete(bowlEntries, change.Path)
+		if options.Merge && slices.Contains(modified, change.Path) {
+			fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified locally, keeping the local file\n", quotePath(change.Path), hash)
+			continue
+		}
+		deleted = append(deleted, BowlEntry{Path: change.Path})
+	}
+	deleteWdFiles(deleted)
+
+	for _, change := range changes {
+		if change.NewHash == "" {
+			continue
+		}
+		if change.OldHash == change.NewHash {
+			bowlEntries[change.Path] = chmodWdFile(bowlEntries[change.Path], change.Mode, bowlMtime)
+			continue
+		}
+		if options.Merge && slices.Contains(modified, change.Path) {
+			bowlEntries[change.Path] = mergeLocalChanges(change, hash)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(change.Path), 0755)
+		if err != nil {
+			panic(err)
+		}
+		writeObjectToFile(change.NewHash, change.Path, change.Mode)
+		bowlEntries[change.Path] = BowlEntry{Hash: change.NewHash, Path: change.Path, Stat: statFile(change.Path)}
+	}
+
+	newBowl := []BowlEntry{}
+	for _, entry := range bowlEntries {
+		newBowl = append(newBowl, entry)
+	}
+	return newBowl
+}
+
+// Returns the changes between the current bowl and the bowl of a tree, sorted
+// by path
+func plungeChanges(currentBowl []BowlEntry, newBowl []BowlEntry) []PlungeChange {
+	changes := make(map[string]*PlungeChange)
+	oldModes := make(map[string]os.FileMode)
+	for _, entry := range currentBowl {
+		changes[entry.Path] = &PlungeChange{Path: entry.Path, OldHash: entry.Hash}
+		oldModes[entry.Path] = entry.Mode()
+	}
+	for _, entry := range newBowl {
+		change, found := changes[entry.Path]
+		if !found {
+			change = &PlungeChange{Path: entry.Path}
+			changes[entry.Path] = change
+		}
+		change.NewHash = entry.Hash
+		change.Mode = entry.Mode()
+		if change.OldHash == change.NewHash && isExecutable(oldModes[entry.Path]) == isExecutable(change.Mode) {
+			delete(changes, entry.Path)
+		}
+	}
+
+	sorted := []PlungeChange{}
+	for _, change := range changes {
+		sorted = append(sorted, *change)
+	}
+	slices.SortFunc(sorted, func(a, b PlungeChange) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return sorted
+}
+
+// Returns the changed paths with local modifications that plunging would
+// overwrite, and the untracked files it would overwrite. Files that already
+// have the plunged content are not conflicts.
+func plungeConflicts(currentBowl []BowlEntry, changes []PlungeChange, bowlMtime int64) (modified []string, untracked []string) {
+	bowlEntries := make(map[string]BowlEntry)
+	for _, entry := range currentBowl {
+		bowlEntries[entry.Path] = entry
+	}
+
+	for _, change := range changes {
+		if change.OldHash == change.NewHash {
+			continue // Only the mode changes, the content is kept
+		}
+		info, err := os.Lstat(change.Path)
+		if err != nil {
+			// Deleted locally, but an untracked file may be in the way of its
+			// directory
+			parent := untrackedParentFile(change.Path, bowlEntries)
+			if change.NewHash != "" && parent != "" && !slices.Contains(untracked, parent) {
+				untracked = append(untracked, parent)
+			}
+			continue
+		}
+		if info.IsDir() {
+			// A directory is only in the way of a file, not of a deletion
+			if change.NewHash != "" {
+				untracked = append(untracked, change.Path)
+			}
+			continue
+		}
+		if change.OldHash != "" && statUnchanged(bowlEntries[change.Path].Stat, statFile(change.Path), bowlMtime) {
+			continue
+		}
+		wdHash := hashFile(change.Path)
+		if wdHash == change.OldHash || wdHash == change.NewHash {
+			continue
+		}
+		if change.OldHash == "" {
+			untracked = append(untracked, change.Path)
+		} else {
+			modified = append(modified, change.Path)
+		}
+	}
+	return modified, untracked
+}
+
+// Returns the bowl of the flush that was last plunged out, or of HEAD if it
+// moved since then. The bowl differs from this only by staged changes.
+func plungeBase() []BowlEntry {
+	head := getHead()
+	headHash := ""
+	if head != nil {
+		headHash = head.Object.Hash
+	}
+	if _, err := os.Stat(PLUNGED_PATH); err == nil {
+		plungedOn, plunged, _ := strings.Cut(readFile(PLUNGED_PATH), " ")
+		if plungedOn == headHash || (head == nil && strings.Trim(plungedOn, "0") == "") {
+			return getObject(getFlush(plunged).TreeHash).ToTree().ToBowl()
+		}
+	}
+	if head == nil {
+		return []BowlEntry{}
+	}
+	return getObject(head.TreeHash).ToTree().ToBowl()
+}
+
+// Returns the closest parent path of a file that exists as an untracked file
+// or symlink instead of a directory, or an empty string if there is none
+func untrackedParentFile(path string, bowlEntries map[string]BowlEntry) string {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if _, tracked := bowlEntries[dir]; info.IsDir() || tracked {
+			return ""
+		}
+		return dir
+	}
+	return ""
+}
+
+// Returns the changed paths whose bowl entries differ from the plunge base,
+// since plunging would discard these staged changes
+func stagedConflicts(currentBowl []BowlEntry, headBowl []BowlEntry, changes []PlungeChange) []string {
+	bowlEntries := bowlMap(currentBowl)
+	headEntries := bowlMap(headBowl)
+	staged := []string{}
+	for _, change := range changes {
+		if !sameEntry(bowlEntries, headEntries, change.Path) {
+			staged = append(staged, change.Path)
+		}
+	}
+	return staged
+}
+
+// Merges the local changes to a file with the changes of the plunged version,
+// writing conflict markers for overlapping changes. Returns the new bowl
+// entry, which has no stat data other than the mode since the merged file
+// differs from its object.
+func mergeLocalChanges(change PlungeChange, hash string) BowlEntry {
+	base := getObject(change.OldHash).Content
+	theirs := getObject(change.NewHash).Content
+	merged, conflicts := merge3(base, readFile(change.Path), theirs, "local", hash)
+	writeFile(change.Path, bytes.NewBufferString(merged))
+	err := os.Chmod(change.Path, change.Mode)
+	if err != nil {
+		panic(err)
+	}
+
+	if conflicts {
+		fmt.Println("CONFLICT (content): Merge conflict in " + quotePath(change.Path))
+	} else {
+		fmt.Println("Merged " + quotePath(change.Path))
+	}
+	return BowlEntry{Hash: change.NewHash, Path: change.Path, Stat: FileStat{Mode: uint32(change.Mode)}}
+}
+
+// Changes the mode of a file whose content is unchanged by plunging, without
+// rewriting it. Returns the updated bowl entry, which keeps no stat data other
+// than the mode if the file has local changes.
+func chmodWdFile(entry BowlEntry, mode os.FileMode, bowlMtime int64) BowlEntry {
+	if _, err := os.Lstat(entry.Path); err != nil {
+		entry.Stat = FileStat{Mode: uint32(mode)} // Deleted locally
+		return entry
+	}
+	unchanged := statUnchanged(entry.Stat, statFile(entry.Path), bowlMtime)
+	err := os.Chmod(entry.Path, mode)
+	if err != nil {
+		panic(err)
+	}
+	if unchanged {
+		entry.Stat = statFile(entry.Path)
+	} else {
+		entry.Stat = FileStat{Mode: uint32(mode)}
+	}
+	return entry
+}
+
+// Returns A for an added path, D for a deleted one and M otherwise
+func changeStatus(change PlungeChange) string {
+	if change.OldHash == "" {
+		return "A"
+	} else if change.NewHash == "" {
+		return "D"
+	}
+	return "M"
+}
+
+func isExecutable(mode os.FileMode) bool {
+	return mode&0111 != 0
+}
+
+func printPaths(paths []string) {
+	for _, path := range paths {
+		fmt.Println("\t" + quotePath(path))
+	}
+}
+
+// Discards local changes by making the tracked workdir files match a target
+// bowl. The current bowl describes the content of the tracked workdir files.
+// Returns the target bowl with the stat data of the written files.
+func resetWorkdir(currentBowl []BowlEntry, targetBowl []BowlEntry) []BowlEntry {
+	changes := plungeChanges(currentBowl, targetBowl)
+	deleted := []BowlEntry{}
+	for _, change := range changes {
+		if change.NewHash == "" {
+			deleted = append(deleted, BowlEntry{Path: change.Path})
+		}
+	}
+	deleteWdFiles(deleted)
+
+	for _, change := range changes {
+		if change.NewHash == "" {
+			continue
+		}
+		if change.OldHash == change.NewHash {
+			err := os.Chmod(change.Path, change.Mode)
+			if err != nil {
+				panic(err)
+			}
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(change.Path), 0755)
+		if err != nil {
+			panic(err)
+		}
+		writeObjectToFile(change.NewHash, change.Path, change.Mode)
+	}
+
+	newBowl := []BowlEntry{}
+	for _, entry := range targetBowl {
+		entry.Stat = statFile(entry.Path)
+		newBowl = append(newBowl, entry)
+	}
+	return newBowl
+}
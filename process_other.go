@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// Without signals a process can't be probed, so locks held by dead processes
+// are only removed once they are older than STALE_LOCK_AGE
+func processExists(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
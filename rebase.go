@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// File that the interactive rebase todo list is edited in
+const REBASE_TODO_PATH = SHIT_PATH + "/REBASE_TODO"
+
+// Short forms of the actions accepted in the rebase todo list
+var REBASE_ACTIONS = map[string]string{
+	"p": "pick", "pick": "pick",
+	"r": "reword", "reword": "reword",
+	"s": "squash", "squash": "squash",
+	"d": "drop", "drop": "drop",
+}
+
+// Replays the flushes of the current branch since it diverged from upstream
+// on top of upstream. With --interactive the user edits the list of flushes
+// first, and may reorder, reword, squash or drop them.
+func cmdRebase(args []string) {
+	if len(args) == 1 && handleSequencerOption("rebase", args[0]) {
+		return
+	}
+	interactive := false
+	upstreamArg := ""
+	for _, arg := range args {
+		if arg == "-i" || arg == "--interactive" {
+			interactive = true
+		} else if upstreamArg == "" && !strings.HasPrefix(arg, "-") {
+			upstreamArg = arg
+		} else {
+			exitUsage()
+		}
+	}
+	if upstreamArg == "" {
+		exitUsage()
+	}
+
+	upstream := resolveRev(upstreamArg)
+	head := getHead()
+	if head == nil {
+		fmt.Println("There are no flushes yet to rebase.")
+		os.Exit(1)
+	}
+	mergeBase := findMergeBase(head.Object.Hash, upstream)
+	if mergeBase == upstream && !interactive {
+		fmt.Println("Current branch " + getHeadRef() + " is up to date.")
+		return
+	}
+
+	steps := []SequencerStep{}
+	for hash := head.Object.Hash; hash != mergeBase; hash = getFlush(hash).ParentHash {
+		steps = append(steps, SequencerStep{Action: "pick", Hash: hash})
+	}
+	slices.Reverse(steps)
+	if interactive {
+		steps = editRebaseTodo(steps, upstream)
+		if len(steps) == 0 {
+			fmt.Println("Nothing to do, the rebase is aborted.")
+			return
+		}
+	}
+	startSequencer("rebase", steps, upstream)
+}
+
+// Lets the user edit the steps of an interactive rebase, and returns the
+// edited steps without the dropped ones. Exits with status 1 if the edited
+// list is invalid.
+func editRebaseTodo(steps []SequencerStep, upstream string) []SequencerStep {
+	buf := bytes.NewBufferString("")
+	for _, step := range steps {
+		summary, _, _ := strings.Cut(getFlush(step.Hash).Message, "\n")
+		buf.WriteString(step.Action + " " + step.Hash[:7] + " " + summary + "\n")
+	}
+	fmt.Fprintf(buf, `
+# Rebase of %d flushes onto %s
+#
+# Actions:
+# p, pick <flush>   = use the flush
+# r, reword <flush> = use the flush, but edit its message
+# s, squash <flush> = use the flush, but meld it into the previous flush
+# d, drop <flush>   = remove the flush
+#
+# The lines can be reordered, and removing a line drops its flush.
+# If you remove everything, the rebase is aborted.
+`, len(steps), upstream[:7])
+	writeFile(REBASE_TODO_PATH, buf)
+	editFile(REBASE_TODO_PATH)
+	todo := readFile(REBASE_TODO_PATH)
+	err := os.Remove(REBASE_TODO_PATH)
+	if err != nil {
+		panic(err)
+	}
+
+	edited := []SequencerStep{}
+	for _, line := range strings.Split(todo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		action, found := REBASE_ACTIONS[fields[0]]
+		if !found || len(fields) < 2 {
+			fmt.Printf("Invalid line in the rebase todo list: %s\n", line)
+			os.Exit(1)
+		}
+		hash := resolveRev(fields[1])
+		if action == "drop" {
+			continue
+		}
+		if action == "squash" && len(edited) == 0 {
+			fmt.Printf("Cannot squash %s without a previous flush.\n", fields[1])
+			os.Exit(1)
+		}
+		edited = append(edited, SequencerStep{Action: action, Hash: hash})
+	}
+	return edited
+}
+
+// Moves HEAD, the bowl and the workdir to the flush a rebase replays onto.
+// Exits with status 1 if that would overwrite local changes.
+func checkoutOnto(command string, head *Flush, onto string) {
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+	bowl := getBowl()
+	bowlMtime := getBowlMtime()
+	changes := plungeChanges(bowl, getObject(getFlush(onto).TreeHash).ToTree().ToBowl())
+	modified, untracked := plungeConflicts(bowl, changes, bowlMtime)
+	if len(modified) > 0 || len(untracked) > 0 {
+		bowlLock.Release()
+		if len(modified) > 0 {
+			fmt.Println("Your local changes to the following files would be overwritten by " + command + ":")
+			printPaths(modified)
+		}
+		if len(untracked) > 0 {
+			fmt.Println("The following untracked files would be overwritten by " + command + ":")
+			printPaths(untracked)
+		}
+		fmt.Println("Flush, stash or remove them first.")
+		os.Exit(1)
+	}
+
+	err := updateRef(getHeadRef(), head.Object.Hash, onto, command+": checkout "+onto)
+	if err != nil {
+		panic(err)
+	}
+	writeBowl(bowlLock, applyPlungeChanges(bowl, changes, nil, nil, PlungeOptions{}, onto, bowlMtime))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Hash prefixes shorter than this are not resolved, since they are likely
+// to be ambiguous
+const MIN_HASH_PREFIX = 4
+
+// Resolves a revision to the hash of a flush, exiting with an error message if
+// it can't be resolved. A revision is HEAD, a ref name, a full hash or a unique
+// hash prefix, optionally followed by ~<n> to select the n-th parent.
+func resolveRev(rev string) string {
+	hash, err := tryResolveRev(rev)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return hash
+}
+
+func tryResolveRev(rev string) (string, error) {
+	name, ancestorsStr, hasAncestors := strings.Cut(rev, "~")
+	ancestors := 0
+	if hasAncestors {
+		ancestors = 1
+		if ancestorsStr != "" {
+			var err error
+			ancestors, err = strconv.Atoi(ancestorsStr)
+			if err != nil || ancestors < 0 {
+				return "", fmt.Errorf("Invalid revision %s, expected <name>~<n>", rev)
+			}
+		}
+	}
+
+	hash, err := resolveRevName(name)
+	if err != nil {
+		return "", err
+	}
+	header, reader := openObject(hash)
+	reader.Close()
+	if header.ObjectType != "flush" {
+		return "", fmt.Errorf("Revision %s is a %s, not a flush", rev, header.ObjectType)
+	}
+	for i := 0; i < ancestors; i++ {
+		hash = getFlush(hash).ParentHash
+		if hash == "" {
+			return "", fmt.Errorf("Revision %s does not exist, %s has only %d ancestors", rev, name, i)
+		}
+	}
+	return hash, nil
+}
+
+func resolveRevName(name string) (string, error) {
+	if name == "HEAD" {
+		head := getHead()
+		if head == nil {
+			return "", fmt.Errorf("HEAD does not point at a flush yet")
+		}
+		return head.Object.Hash, nil
+	}
+	if !strings.Contains(name, "..") {
+		if info, err := os.Stat(filepath.Join(REFS_PATH, name)); err == nil && info.Mode().IsRegular() {
+			return readRef(name), nil
+		}
+	}
+	if isObjectName(name) && objectExists(name) {
+		return name, nil
+	}
+
+	if _, err := hex.DecodeString(name + strings.Repeat("0", len(name)%2)); err != nil || len(name) < MIN_HASH_PREFIX {
+		return "", fmt.Errorf("Unknown revision %s", name)
+	}
+	hashes := listLooseObjects()
+	for _, pack := range getPacks() {
+		hashes = append(hashes, pack.hashes()...)
+	}
+	match := ""
+	for _, hash := range hashes {
+		if !strings.HasPrefix(hash, name) || hash == match {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("Ambiguous revision %s, it matches both %s and %s", name, match, hash)
+		}
+		match = hash
+	}
+	if match == "" {
+		return "", fmt.Errorf("Unknown revision %s", name)
+	}
+	return match, nil
+}
+
+// Returns the nearest flush that is an ancestor of both a and b, or an empty
+// string if they have no common history
+func findMergeBase(a string, b string) string {
+	ancestors := make(map[string]bool)
+	for hash := b; hash != ""; hash = getFlush(hash).ParentHash {
+		ancestors[hash] = true
+	}
+	for hash := a; hash != ""; hash = getFlush(hash).ParentHash {
+		if ancestors[hash] {
+			return hash
+		}
+	}
+	return ""
+}
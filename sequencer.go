@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The sequencer applies or reverts a list of flushes one by one, stopping
+// when a flush conflicts with the current tree or a message is left empty.
+// Its state is kept in this directory until all steps are done or the
+// operation is aborted:
+//
+//	command    the command that started the sequencer, e.g. cherry-pick
+//	head       the HEAD flush before the command started, restored by --abort
+//	todo       the remaining steps, one "<action> <hash>" per line
+//	conflicts  the conflicting paths of the stopped step, one per line
+//	message    the flush message of the stopped step
+const SEQUENCER_PATH = SHIT_PATH + "/sequencer"
+
+type SequencerStep struct {
+	Action string // pick, revert, reword or squash
+	Hash   string
+}
+
+func cmdCherryPick(args []string) {
+	if len(args) == 0 {
+		exitUsage()
+	}
+	if len(args) == 1 && handleSequencerOption("cherry-pick", args[0]) {
+		return
+	}
+	steps := []SequencerStep{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			exitUsage()
+		}
+		steps = append(steps, SequencerStep{Action: "pick", Hash: resolveRev(arg)})
+	}
+	startSequencer("cherry-pick", steps, "")
+}
+
+func cmdRevert(args []string) {
+	if len(args) == 0 {
+		exitUsage()
+	}
+	if len(args) == 1 && handleSequencerOption("revert", args[0]) {
+		return
+	}
+	steps := []SequencerStep{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			exitUsage()
+		}
+		steps = append(steps, SequencerStep{Action: "revert", Hash: resolveRev(arg)})
+	}
+	startSequencer("revert", steps, "")
+}
+
+// Handles --continue, --skip and --abort of a stopped command. Returns false
+// if the argument is not a sequencer option.
+func handleSequencerOption(command string, arg string) bool {
+	switch arg {
+	case "--continue":
+		continueSequencer(command)
+	case "--skip":
+		skipSequencer(command)
+	case "--abort":
+		abortSequencer(command)
+	default:
+		return false
+	}
+	return true
+}
+
+// Starts applying the steps on HEAD. If onto is set, HEAD and the workdir are
+// first moved to that flush.
+func startSequencer(command string, steps []SequencerStep, onto string) {
+	if _, err := os.Stat(SEQUENCER_PATH); err == nil {
+		inProgress := readFile(filepath.Join(SEQUENCER_PATH, "command"))
+		fmt.Printf("A %s is already in progress, run \"shit %s --continue\" or \"shit %s --abort\" first.\n", inProgress, inProgress, inProgress)
+		os.Exit(1)
+	}
+	head := getHead()
+	if head == nil {
+		fmt.Println("There are no flushes yet to " + command + " onto.")
+		os.Exit(1)
+	}
+	bowlLock := lockBowl()
+	bowlTree := createTree(getBowl())
+	bowlLock.Release()
+	if bowlTree.Object.Hash != head.TreeHash {
+		fmt.Println("Your bowl contains changes that are not flushed, flush or stash them first.")
+		os.Exit(1)
+	}
+	// Local changes are checked for all steps before any state is written, so
+	// that a refused command leaves nothing to abort
+	if modified, untracked := sequencerConflicts(steps); len(modified) > 0 || len(untracked) > 0 {
+		fmt.Println("Your local changes to the following files would be overwritten by " + command + ":")
+		printPaths(append(modified, untracked...))
+		fmt.Println("Flush, stash or remove them first.")
+		os.Exit(1)
+	}
+	if onto != "" {
+		checkoutOnto(command, head, onto)
+	}
+
+	err := os.MkdirAll(SEQUENCER_PATH, 0775)
+	if err != nil {
+		panic(err)
+	}
+	writeFile(filepath.Join(SEQUENCER_PATH, "command"), bytes.NewBufferString(command))
+	writeFile(filepath.Join(SEQUENCER_PATH, "head"), bytes.NewBufferString(head.Object.Hash))
+	writeSequencerTodo(steps)
+	runSequencer(command)
+}
+
+// Applies the remaining steps, removing the sequencer state once all are done.
+// Exits with status 1 if a step stops with conflicts.
+func runSequencer(command string) {
+	todo := readSequencerTodo()
+	for len(todo) > 0 {
+		if !applySequencerStep(todo[0]) {
+			exitSequencerStopped(command)
+		}
+		todo = todo[1:]
+		writeSequencerTodo(todo)
+	}
+	err := os.RemoveAll(SEQUENCER_PATH)
+	if err != nil {
+		panic(err)
+	}
+	if command == "rebase" {
+		fmt.Println("Successfully rebased and updated " + getHeadRef())
+	}
+}
+
+func exitSequencerStopped(command string) {
+	fmt.Printf("Resolve the conflicts and add the resolved files with \"shit add\", then run \"shit %s --continue\". Run \"shit %s --skip\" to skip this flush, or \"shit %s --abort\" to cancel.\n", command, command, command)
+	os.Exit(1)
+}
+
+// Merges the changes of a step into the bowl and workdir, and flushes them.
+// Returns false if the step stopped with conflicts.
+func applySequencerStep(step SequencerStep) bool {
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+
+	flush := getFlush(step.Hash)
+	message := strings.TrimSuffix(flush.Message, "\n")
+	summary, _, _ := strings.Cut(message, "\n")
+	label := flush.Object.Hash[:7] + " (" + summary + ")"
+
+	base, theirs := stepBowls(step)
+	if step.Action == "revert" {
+		message = fmt.Sprintf("Revert \"%s\"\n\nThis reverts flush %s.", summary, flush.Object.Hash)
+		label = "parent of " + label
+	}
+
+	currentBowl := getBowl()
+	ours := bowlMap(currentBowl)
+	paths := changedPaths(base, theirs)
+	changes := []PlungeChange{}
+	for _, path := range paths {
+		changes = append(changes, PlungeChange{Path: path, OldHash: ours[path].Hash, NewHash: theirs[path].Hash})
+	}
+	modified, untracked := plungeConflicts(currentBowl, changes, getBowlMtime())
+	if len(modified) > 0 || len(untracked) > 0 {
+		bowlLock.Release()
+		fmt.Println("Your local changes to the following files would be overwritten by " + label + ":")
+		printPaths(append(modified, untracked...))
+		fmt.Println("Flush, stash or remove them first.")
+		os.Exit(1)
+	}
+
+	merged, conflicts := mergeTrees(base, ours, theirs, paths, "HEAD", label)
+	newBowl := []BowlEntry{}
+	for _, entry := range merged {
+		newBowl = append(newBowl, entry)
+	}
+	writeBowl(bowlLock, newBowl)
+
+	if len(conflicts) > 0 {
+		saveSequencerStop(conflicts, message)
+		fmt.Println("Could not apply " + label)
+		return false
+	}
+	return finishSequencerStep(step, newBowl, message)
+}
+
+// Records a stopped step, so that --continue flushes the bowl with the message
+func saveSequencerStop(conflicts []string, message string) {
+	quoted := []string{}
+	for _, path := range conflicts {
+		quoted = append(quoted, quotePath(path)+"\n")
+	}
+	writeFile(filepath.Join(SEQUENCER_PATH, "conflicts"), bytes.NewBufferString(strings.Join(quoted, "")))
+	writeFile(filepath.Join(SEQUENCER_PATH, "message"), bytes.NewBufferString(message))
+}
+
+// Returns the bowls a step applies the changes between. A pick applies the
+// changes from the parent to the flush, a revert applies them in reverse.
+func stepBowls(step SequencerStep) (base map[string]BowlEntry, theirs map[string]BowlEntry) {
+	flush := getFlush(step.Hash)
+	base = flushBowl(flush.ParentHash)
+	theirs = flushBowl(flush.Object.Hash)
+	if step.Action == "revert" {
+		base, theirs = theirs, base
+	}
+	return base, theirs
+}
+
+// Returns the local changes and untracked files that any of the steps would
+// overwrite
+func sequencerConflicts(steps []SequencerStep) (modified []string, untracked []string) {
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+	bowl := getBowl()
+	bowlMtime := getBowlMtime()
+	ours := bowlMap(bowl)
+	for _, step := range steps {
+		base, theirs := stepBowls(step)
+		changes := []PlungeChange{}
+		for _, path := range changedPaths(base, theirs) {
+			changes = append(changes, PlungeChange{Path: path, OldHash: ours[path].Hash, NewHash: theirs[path].Hash})
+		}
+		stepModified, stepUntracked := plungeConflicts(bowl, changes, bowlMtime)
+		modified = append(modified, stepModified...)
+		untracked = append(untracked, stepUntracked...)
+	}
+	slices.Sort(modified)
+	slices.Sort(untracked)
+	return slices.Compact(modified), slices.Compact(untracked)
+}
+
+// Returns the bowl of the tree of a flush, or an empty bowl for no flush
+func flushBowl(hash string) map[string]BowlEntry {
+	if hash == "" {
+		return map[string]BowlEntry{}
+	}
+	return bowlMap(getObject(getFlush(hash).TreeHash).ToTree().ToBowl())
+}
+
+// Flushes the bowl of a step, unless it has no changes compared to HEAD. A
+// reword lets the user edit the message, and a squash replaces HEAD with a
+// flush that combines both messages. Returns false if the user aborted the
+// flush with an empty message.
+func finishSequencerStep(step SequencerStep, bowl []BowlEntry, message string) bool {
+	head := getHead()
+	edited := message
+	switch step.Action {
+	case "squash":
+		edited = strings.TrimSuffix(head.Message, "\n") + "\n\n" + message
+		fallthrough
+	case "reword":
+		edited = editMessage(edited, "Please enter the flush message. Lines starting with '#' are ignored,\nand an empty message stops the "+step.Action+".")
+		if edited == "" {
+			saveSequencerStop(nil, message)
+			fmt.Println("Aborting flush due to empty message.")
+			return false
+		}
+	}
+
+	tree := createTree(bowl)
+	if step.Action == "squash" {
+		flush := createFlushObject(tree.Object.Hash, head.ParentHash, head.Author, edited)
+		err := updateRef(getHeadRef(), head.Object.Hash, flush.Hash, "rebase: squash "+step.Hash)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Created flush " + flush.Hash)
+		return true
+	}
+	if tree.Object.Hash == head.TreeHash {
+		summary, _, _ := strings.Cut(message, "\n")
+		fmt.Println("Nothing to flush for \"" + summary + "\", its changes are already applied")
+		return true
+	}
+	createFlush(tree, head, stepAuthor(step), edited)
+	return true
+}
+
+// Returns the author of the flush a step creates. Picked flushes keep their
+// original author, while a revert is a new change by the current user.
+func stepAuthor(step SequencerStep) string {
+	if step.Action == "revert" {
+		return flushAuthor()
+	}
+	return getFlush(step.Hash).Author
+}
+
+// Returns the sorted paths whose entries differ between two bowls
+func changedPaths(a map[string]BowlEntry, b map[string]BowlEntry) []string {
+	paths := []string{}
+	for _, entries := range []map[string]BowlEntry{a, b} {
+		for path := range entries {
+			if !sameEntry(a, b, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// Applies the changes from base to theirs at the given paths to the bowl
+// ours, writing the results to the workdir. Paths changed on both sides are
+// merged line by line. Returns the merged bowl and the paths with conflicts,
+// which keep the entry of ours in the bowl.
+func mergeTrees(base, ours, theirs map[string]BowlEntry, paths []string, oursLabel string, theirsLabel string) (map[string]BowlEntry, []string) {
+	merged := make(map[string]BowlEntry)
+	for path, entry := range ours {
+		merged[path] = entry
+	}
+	conflicts := []string{}
+
+	for _, path := range paths {
+		theirsEntry, inTheirs := theirs[path]
+		oursEntry, inOurs := ours[path]
+		if sameEntry(ours, theirs, path) {
+			continue
+		}
+		if sameEntry(ours, base, path) {
+			if !inTheirs {
+				delete(merged, path)
+				deleteWdFiles([]BowlEntry{{Path: path}})
+				continue
+			}
+			merged[path] = writeWdEntry(theirsEntry.Hash, path, theirsEntry.Mode())
+			continue
+		}
+
+		if !inOurs {
+			conflicts = append(conflicts, path)
+			fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified in %s\n", quotePath(path), oursLabel, theirsLabel)
+			writeWdEntry(theirsEntry.Hash, path, theirsEntry.Mode())
+			continue
+		}
+		if !inTheirs {
+			conflicts = append(conflicts, path)
+			fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified in %s\n", quotePath(path), theirsLabel, oursLabel)
+			continue
+		}
+
+		// Take the mode change of theirs unless ours changed the mode as well
+		mode := oursEntry.Mode()
+		if baseEntry, inBase := base[path]; !inBase || isExecutable(baseEntry.Mode()) == isExecutable(mode) {
+			mode = theirsEntry.Mode()
+		}
+		baseContent := ""
+		if baseEntry, inBase := base[path]; inBase {
+			baseContent = getObject(baseEntry.Hash).Content
+		}
+		content, contentConflicts := merge3(baseContent, getObject(oursEntry.Hash).Content, getObject(theirsEntry.Hash).Content, oursLabel, theirsLabel)
+		if !contentConflicts {
+			fmt.Println("Merged " + quotePath(path))
+			merged[path] = writeWdEntry(createObject("file", content).Hash, path, mode)
+			continue
+		}
+		conflicts = append(conflicts, path)
+		fmt.Println("CONFLICT (content): Merge conflict in " + quotePath(path))
+		writeFile(path, bytes.NewBufferString(content))
+		err := os.Chmod(path, mode)
+		if err != nil {
+			panic(err)
+		}
+		merged[path] = BowlEntry{Hash: oursEntry.Hash, Path: path, Stat: FileStat{Mode: oursEntry.Stat.Mode}}
+	}
+	return merged, conflicts
+}
+
+// Writes a file object to the workdir and returns its bowl entry
+func writeWdEntry(hash string, path string, mode os.FileMode) BowlEntry {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		panic(err)
+	}
+	writeObjectToFile(hash, path, mode)
+	return BowlEntry{Hash: hash, Path: path, Stat: statFile(path)}
+}
+
+// Flushes the resolved conflicts of the stopped step and applies the
+// remaining steps
+func continueSequencer(command string) {
+	checkSequencerCommand(command)
+	conflictsPath := filepath.Join(SEQUENCER_PATH, "conflicts")
+	if _, err := os.Stat(conflictsPath); err == nil {
+		bowlLock := lockBowl()
+		bowl := getBowl()
+		unresolved := unresolvedConflicts(bowl, strings.Split(readFile(conflictsPath), "\n"))
+		if len(unresolved) > 0 {
+			bowlLock.Release()
+			fmt.Println("The following conflicts are not resolved yet:")
+			printPaths(unresolved)
+			fmt.Println("Remove the conflict markers and add the files with \"shit add\" first.")
+			os.Exit(1)
+		}
+		step := readSequencerTodo()[0]
+		finished := finishSequencerStep(step, bowl, readFile(filepath.Join(SEQUENCER_PATH, "message")))
+		bowlLock.Release()
+		if !finished {
+			exitSequencerStopped(command)
+		}
+
+		os.Remove(conflictsPath)
+		os.Remove(filepath.Join(SEQUENCER_PATH, "message"))
+		writeSequencerTodo(readSequencerTodo()[1:])
+	}
+	runSequencer(command)
+}
+
+// Returns the conflicting paths that still have conflict markers, or whose
+// workdir file is not added to the bowl
+func unresolvedConflicts(bowl []BowlEntry, quotedPaths []string) []string {
+	entries := bowlMap(bowl)
+	unresolved := []string{}
+	for _, quoted := range quotedPaths {
+		if quoted == "" {
+			continue
+		}
+		path := unquotePath(quoted)
+		entry, inBowl := entries[path]
+		if _, err := os.Lstat(path); err != nil {
+			if inBowl {
+				unresolved = append(unresolved, path)
+			}
+			continue
+		}
+		content := readFile(path)
+		hasMarkers := strings.HasPrefix(content, "<<<<<<< ") || strings.Contains(content, "\n<<<<<<< ")
+		if hasMarkers || !inBowl || hashFile(path) != entry.Hash {
+			unresolved = append(unresolved, path)
+		}
+	}
+	return unresolved
+}
+
+// Discards the changes of the stopped step and applies the remaining steps
+func skipSequencer(command string) {
+	checkSequencerCommand(command)
+	conflictsPath := filepath.Join(SEQUENCER_PATH, "conflicts")
+	if _, err := os.Stat(conflictsPath); err == nil {
+		bowlLock := lockBowl()
+		resetSequencerWorkdir(bowlLock, getHead().Object.Hash)
+		os.Remove(conflictsPath)
+		os.Remove(filepath.Join(SEQUENCER_PATH, "message"))
+	}
+	writeSequencerTodo(readSequencerTodo()[1:])
+	runSequencer(command)
+}
+
+// Restores HEAD, the bowl and the workdir to the state before the command
+// started, discarding the applied steps and any conflict resolution
+func abortSequencer(command string) {
+	checkSequencerCommand(command)
+	origHead := readFile(filepath.Join(SEQUENCER_PATH, "head"))
+
+	headRef := getHeadRef()
+	err := updateRef(headRef, readRef(headRef), origHead, command+": abort")
+	if err != nil {
+		panic(err)
+	}
+	resetSequencerWorkdir(lockBowl(), origHead)
+
+	err = os.RemoveAll(SEQUENCER_PATH)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Aborted " + command + ", HEAD is back at " + origHead)
+}
+
+// Resets the paths the sequencer wrote to a flush, and writes the bowl with
+// the lock. These are the paths whose bowl entries differ from the flush and
+// the conflicting paths. Local changes to other files are kept.
+func resetSequencerWorkdir(bowlLock *LockFile, hash string) {
+	bowl := getBowl()
+	entries := bowlMap(bowl)
+	targetBowl := getObject(getFlush(hash).TreeHash).ToTree().ToBowl()
+	paths := make(map[string]bool)
+	for _, change := range plungeChanges(bowl, targetBowl) {
+		paths[change.Path] = true
+	}
+	conflictsPath := filepath.Join(SEQUENCER_PATH, "conflicts")
+	if _, err := os.Stat(conflictsPath); err == nil {
+		for _, quoted := range strings.Split(readFile(conflictsPath), "\n") {
+			if quoted != "" {
+				paths[unquotePath(quoted)] = true
+			}
+		}
+	}
+
+	// Conflicting files that are not in the bowl are removed as well
+	written := []BowlEntry{}
+	newBowl := []BowlEntry{}
+	for path := range paths {
+		if entry, inBowl := entries[path]; inBowl {
+			written = append(written, entry)
+		} else {
+			written = append(written, BowlEntry{Path: path})
+		}
+	}
+	for _, entry := range bowl {
+		if !paths[entry.Path] {
+			newBowl = append(newBowl, entry)
+		}
+	}
+	target := []BowlEntry{}
+	for _, entry := range targetBowl {
+		if paths[entry.Path] {
+			target = append(target, entry)
+		}
+	}
+	newBowl = append(newBowl, resetWorkdir(workdirBowl(written, getBowlMtime()), target)...)
+	writeBowl(bowlLock, newBowl)
+}
+
+func checkSequencerCommand(command string) {
+	commandPath := filepath.Join(SEQUENCER_PATH, "command")
+	if _, err := os.Stat(commandPath); err != nil || readFile(commandPath) != command {
+		fmt.Println("No " + command + " in progress.")
+		os.Exit(1)
+	}
+}
+
+func readSequencerTodo() []SequencerStep {
+	steps := []SequencerStep{}
+	for _, line := range strings.Split(readFile(filepath.Join(SEQUENCER_PATH, "todo")), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			steps = append(steps, SequencerStep{Action: fields[0], Hash: fields[1]})
+		}
+	}
+	return steps
+}
+
+func writeSequencerTodo(steps []SequencerStep) {
+	buf := new(bytes.Buffer)
+	for _, step := range steps {
+		fmt.Fprintf(buf, "%s %s\n", step.Action, step.Hash)
+	}
+	writeFile(filepath.Join(SEQUENCER_PATH, "todo"), buf)
+}
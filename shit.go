@@ -1,19 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/zlib"
-	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
+	"unicode"
 )
 
 const SHIT_PATH = ".shit"
@@ -21,6 +25,16 @@ const HEAD_PATH = SHIT_PATH + "/HEAD"
 const BOWL_PATH = SHIT_PATH + "/bowl"
 const OBJECTS_PATH = SHIT_PATH + "/objects"
 const REFS_PATH = SHIT_PATH + "/refs"
+const LOGS_PATH = SHIT_PATH + "/logs"
+
+// First line of a bowl written in the quoted text format. Bowls without it
+// are in the legacy text format. Both are migrated to the binary index the
+// next time the bowl is written.
+const BOWL_HEADER = "shit-bowl 2"
+
+// The bowl index starts with this magic followed by the index version
+const BOWL_INDEX_MAGIC = "SBWL"
+const BOWL_INDEX_VERSION = 3
 
 type Command struct {
 	Action string
@@ -41,13 +55,22 @@ type Object struct {
 }
 
 func (object Object) ToFlush() Flush {
-	lines := strings.Split(object.Content, "\n")
-	tree := strings.Split(lines[0], " ")[1]
-	parent := strings.Split(lines[1], " ")[1]
-	date := strings.Split(lines[2], " ")[1]
-	message := strings.Join(lines[4:], "\n")
-
-	return Flush{Object: object, Date: date, ParentHash: parent, TreeHash: tree, Message: message}
+	headers, message, _ := strings.Cut(object.Content, "\n\n")
+	flush := Flush{Object: object, Message: message}
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			flush.TreeHash = value
+		case "parent":
+			flush.ParentHash = value
+		case "time":
+			flush.Date, _, _ = strings.Cut(value, " ")
+		case "author":
+			flush.Author = value
+		}
+	}
+	return flush
 }
 
 func (object Object) ToTree() Tree {
@@ -55,8 +78,8 @@ func (object Object) ToTree() Tree {
 	nodes := []TreeNode{}
 	for _, line := range lines {
 		if len(line) > 0 {
-			parts := strings.Split(line, " ")
-			nodes = append(nodes, TreeNode{Name: parts[2], NodeType: parts[0], Hash: parts[1]})
+			parts := strings.SplitN(line, " ", 3)
+			nodes = append(nodes, TreeNode{Name: unquotePath(parts[2]), NodeType: parts[0], Hash: parts[1]})
 		}
 	}
 	return Tree{Object: object, Nodes: nodes}
@@ -67,10 +90,10 @@ func (tree Tree) ToBowl() []BowlEntry {
 	createEntries = func(root string, tree Tree) []BowlEntry {
 		entries := []BowlEntry{}
 		for _, node := range tree.Nodes {
-			if node.NodeType == "file" {
-				object := getObject(node.Hash)
+			if node.IsFile() {
+				// Only the mode of the stat data is known
 				path := filepath.Join(root, node.Name)
-				entries = append(entries, BowlEntry{object, path})
+				entries = append(entries, BowlEntry{Hash: node.Hash, Path: path, Stat: FileStat{Mode: uint32(node.Mode())}})
 			}
 			if node.NodeType == "tree" {
 				tree := getObject(node.Hash).ToTree()
@@ -83,9 +106,30 @@ func (tree Tree) ToBowl() []BowlEntry {
 	return createEntries("./", tree)
 }
 
+// A bowl entry only carries the object hash and stat data of a file, the
+// object itself is loaded on demand with Object
 type BowlEntry struct {
-	Object Object
-	Path   string
+	Hash string
+	Path string
+	Stat FileStat
+}
+
+func (entry BowlEntry) Object() Object {
+	return getObject(entry.Hash)
+}
+
+func (entry BowlEntry) Mode() os.FileMode {
+	return os.FileMode(entry.Stat.Mode)
+}
+
+// Stat data of a workdir file at the time it was added to the bowl. A file
+// whose stat data still matches its bowl entry is not rehashed.
+type FileStat struct {
+	Ctime int64 // Nanoseconds since epoch
+	Mtime int64 // Nanoseconds since epoch
+	Size  int64
+	Inode uint64
+	Mode  uint32
 }
 
 type Flush struct {
@@ -93,6 +137,7 @@ type Flush struct {
 	Date       string
 	ParentHash string
 	TreeHash   string
+	Author     string // Empty for flushes made without user.name or user.email
 	Message    string
 }
 
@@ -104,9 +149,8 @@ type Tree struct {
 func (tree Tree) ToBowlEntries(root string) []BowlEntry {
 	bowl := []BowlEntry{}
 	for _, node := range tree.Nodes {
-		if node.NodeType == "file" {
-			object := getObject(node.Hash)
-			bowl = addToBowl(bowl, BowlEntry{Object: object, Path: root})
+		if node.IsFile() {
+			bowl = addToBowl(bowl, BowlEntry{Hash: node.Hash, Path: root, Stat: FileStat{Mode: uint32(node.Mode())}})
 		} else if node.NodeType == "tree" {
 			subtree := getTree(node.Hash)
 			bowl = addToBowl(bowl, subtree.ToBowlEntries(node.Name)...)
@@ -117,12 +161,29 @@ func (tree Tree) ToBowlEntries(root string) []BowlEntry {
 
 type TreeNode struct {
 	Name     string
-	NodeType string // file or tree
+	NodeType string // file, exec or tree
 	Hash     string
 }
 
+// Executable files are stored as exec nodes, other files as file nodes. Both
+// refer to file objects.
+func (node TreeNode) IsFile() bool {
+	return node.NodeType == "file" || node.NodeType == "exec"
+}
+
+// Returns the mode a file node is written to the workdir with
+func (node TreeNode) Mode() os.FileMode {
+	if node.NodeType == "exec" {
+		return 0755
+	}
+	return 0644
+}
+
 func main() {
 	command := parseArgs()
+	resetConfig()
+	resetPacks()
+	resetKnownObjects()
 
 	if command.Action == "--help" {
 		exitUsage()
@@ -132,7 +193,7 @@ func main() {
 
 	switch command.Action {
 	case "init":
-		cmdInitShit()
+		cmdInitShit(command.Args)
 	case "add":
 		cmdAdd(command.Args)
 	case "get-object":
@@ -147,6 +208,28 @@ func main() {
 		cmdCreateTree()
 	case "plunge":
 		cmdPlunge(command.Args)
+	case "migrate-objects":
+		cmdMigrateObjects()
+	case "pack":
+		cmdPack()
+	case "gc":
+		cmdGc(command.Args)
+	case "prune":
+		cmdPrune(command.Args)
+	case "fsck":
+		cmdFsck()
+	case "config":
+		cmdConfig(command.Args)
+	case "stash":
+		cmdStash(command.Args)
+	case "cherry-pick":
+		cmdCherryPick(command.Args)
+	case "revert":
+		cmdRevert(command.Args)
+	case "rebase":
+		cmdRebase(command.Args)
+	case "blame":
+		cmdBlame(command.Args)
 	default:
 		exitUsage()
 	}
@@ -160,7 +243,20 @@ func parseArgs() Command {
 	return Command{Action: os.Args[1], Args: os.Args[2:]}
 }
 
-func cmdInitShit() {
+func cmdInitShit(args []string) {
+	objectFormat := DEFAULT_OBJECT_FORMAT
+	for _, arg := range args {
+		format, found := strings.CutPrefix(arg, "--object-format=")
+		if !found {
+			exitUsage()
+		}
+		if _, supported := OBJECT_FORMATS[format]; !supported {
+			fmt.Printf("Unsupported object format %s, expected sha1 or sha256.\n", format)
+			exitUsage()
+		}
+		objectFormat = format
+	}
+
 	createFs := func(t string, path string) {
 		var err error
 		if t == "dir" {
@@ -177,6 +273,7 @@ func cmdInitShit() {
 	createFs("file", BOWL_PATH)
 	createFs("dir", REFS_PATH)
 	writeFile(HEAD_PATH, bytes.NewBuffer([]byte("master")))
+	setConfig("core.objectFormat", objectFormat)
 }
 
 func cmdAdd(args []string) {
@@ -184,7 +281,10 @@ func cmdAdd(args []string) {
 		exitUsage()
 	}
 
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
 	bowl := getBowl()
+	bowlMtime := getBowlMtime()
 	workdir := getWorkdir()
 	var addList []string
 
@@ -200,34 +300,111 @@ func cmdAdd(args []string) {
 		addList = append(addList, args...)
 	}
 
-	for _, addFile := range addList {
-		var existingWdFile *string
-		var oldBowlEntry *BowlEntry
+	bowlEntries := make(map[string]BowlEntry)
+	for _, bowlEntry := range bowl {
+		bowlEntries[bowlEntry.Path] = bowlEntry
+	}
+	workdirFiles := make(map[string]bool)
+	for _, wdFile := range workdir {
+		workdirFiles[wdFile] = true
+	}
 
-		for _, wdFile := range workdir {
-			if wdFile == addFile {
-				existingWdFile = &wdFile
-			}
+	// Collect the files that changed since they were added, to be hashed in parallel
+	changed := []BowlEntry{}
+	seen := make(map[string]bool)
+	for _, addFile := range addList {
+		if seen[addFile] {
+			continue
 		}
-		for _, bowlEntry := range bowl {
-			if bowlEntry.Path == addFile {
-				oldBowlEntry = &bowlEntry
+		seen[addFile] = true
+
+		oldBowlEntry, inBowl := bowlEntries[addFile]
+		if workdirFiles[addFile] {
+			stat := statFile(addFile)
+			if inBowl && statUnchanged(oldBowlEntry.Stat, stat, bowlMtime) {
+				continue
 			}
+			changed = append(changed, BowlEntry{Path: addFile, Stat: stat})
 		}
-		if existingWdFile != nil {
-			object := createObject("file", readFile(*existingWdFile))
-			bowlEntry := BowlEntry{Object: object, Path: *existingWdFile}
-			bowl = addToBowl(bowl, bowlEntry)
-		}
-		if existingWdFile == nil && oldBowlEntry != nil {
-			bowl = removeFromBowl(bowl, addFile)
+		if !workdirFiles[addFile] && inBowl {
+			delete(bowlEntries, addFile)
 		}
-		if existingWdFile == nil && oldBowlEntry == nil {
+		if !workdirFiles[addFile] && !inBowl {
 			panic(fmt.Sprintf("File with path %s not found in neither workdir or bowl", addFile))
 		}
 	}
 
-	writeBowl(bowl)
+	createFileObjects(changed)
+	for _, bowlEntry := range changed {
+		bowlEntries[bowlEntry.Path] = bowlEntry
+	}
+
+	bowl = []BowlEntry{}
+	for _, bowlEntry := range bowlEntries {
+		bowl = append(bowl, bowlEntry)
+	}
+	writeBowl(bowlLock, bowl)
+}
+
+// Creates objects for the files of the bowl entries on a pool of workers, one
+// per CPU. Each worker streams one file at a time, so memory use is bounded
+// regardless of file sizes. The objects are set on the entries in place.
+func createFileObjects(entries []BowlEntry) {
+	// Load shared state up front so that workers only read it
+	getConfig()
+	getPacks()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(entries)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				entries[i].Hash = createFileObject(entries[i].Path).Hash
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Creates the object for a file. The file is hashed first, and only
+// compressed and written if no object with that hash exists yet.
+func createFileObject(path string) Object {
+	header, _ := addHeader("file", "")
+	hash := hashFile(path)
+	if objectExists(hash) {
+		return Object{Hash: hash, Header: header}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	return createObjectFromReader("file", file)
+}
+
+// Returns the hash the file would have as a file object, without writing it
+func hashFile(path string) string {
+	header, _ := addHeader("file", "")
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	hasher := newHasher()
+	hasher.Write([]byte(header.Content))
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
 func cmdGetObject(args []string) {
@@ -236,15 +413,20 @@ func cmdGetObject(args []string) {
 	}
 
 	hash := args[0]
-	object := getObject(hash)
-	fmt.Print(string(object.Bytes))
+	header, reader := openObject(hash)
+	defer reader.Close()
+	fmt.Print(header.Content)
+	_, err := io.Copy(os.Stdout, reader)
+	if err != nil {
+		panic(err)
+	}
 }
 
 // TODO show added/modified/deleted instead of just printing the bowl
 func cmdSniff() {
 	bowl := getBowl()
 	for _, entry := range bowl {
-		fmt.Printf("%s %s\n", entry.Object.Hash, entry.Path)
+		fmt.Printf("%s %s\n", entry.Hash, quotePath(entry.Path))
 	}
 }
 
@@ -263,20 +445,85 @@ func printLog(flush Flush) {
 }
 
 func cmdFlush(args []string) {
-	if len(args) < 2 || args[0] != "-m" {
-		fmt.Println("A message is required when flusing (-m <message>).")
-		exitUsage()
+	message := ""
+	hasMessage := false
+	amend := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--amend" {
+			amend = true
+		} else if args[i] == "-m" && i+1 < len(args) && !hasMessage {
+			message = args[i+1]
+			hasMessage = true
+			i++
+		} else if args[i] == "-F" && i+1 < len(args) && !hasMessage {
+			message = readMessageFile(args[i+1])
+			if message == "" {
+				fmt.Println("Aborting flush due to empty message.")
+				os.Exit(1)
+			}
+			hasMessage = true
+			i++
+		} else {
+			exitUsage()
+		}
 	}
 
+	// The bowl is locked before the hooks run, so that the flushed bowl is the
+	// one the pre-flush hook checked
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+	abort := func(message string) {
+		bowlLock.Release()
+		fmt.Println(message)
+		os.Exit(1)
+	}
 	bowl := getBowl()
 	if len(bowl) == 0 {
+		bowlLock.Release()
 		fmt.Println("Your bowl is empty, add files to bowl with \"flush add <filename>\" first.")
 		exitUsage()
 	}
+	parent := getHead()
+	if amend && parent == nil {
+		abort("There is no flush to amend yet.")
+	}
+	runPreHook(bowlLock, "pre-flush", "flush", nil, hookChanges(stagedChanges(bowl)))
+
+	if !hasMessage && amend {
+		message = strings.TrimSuffix(parent.Message, "\n")
+	} else if !hasMessage {
+		message = editFlushMessage()
+		if message == "" {
+			abort("Aborting flush due to empty message.")
+		}
+	}
+	if _, err := os.Stat(filepath.Join(HOOKS_PATH, "flush-msg")); err == nil {
+		writeFile(FLUSH_EDITMSG_PATH, bytes.NewBufferString(message+"\n"))
+		runPreHook(bowlLock, "flush-msg", "flush", []string{FLUSH_EDITMSG_PATH}, nil)
+		message = readMessageFile(FLUSH_EDITMSG_PATH)
+		if message == "" {
+			abort("Aborting flush due to empty message.")
+		}
+	}
 
 	tree := createTree(bowl)
-	parent := getHead()
-	createFlush(tree, parent, args[1])
+	hash := ""
+	if amend {
+		hash = amendFlush(tree, parent, message)
+	} else {
+		hash = createFlush(tree, parent, flushAuthor(), message)
+	}
+	bowlLock.Release()
+	runHook("post-flush", []string{hash}, nil)
+}
+
+// Returns the changes of the bowl relative to HEAD
+func stagedChanges(bowl []BowlEntry) []PlungeChange {
+	headBowl := []BowlEntry{}
+	if head := getHead(); head != nil {
+		headBowl = getObject(head.TreeHash).ToTree().ToBowl()
+	}
+	return plungeChanges(headBowl, bowl)
 }
 
 func cmdCreateTree() {
@@ -285,22 +532,33 @@ func cmdCreateTree() {
 	fmt.Println("Created tree " + tree.Object.Hash)
 }
 
-func cmdPlunge(args []string) {
-	if len(args) > 1 {
-		exitUsage()
+// Moves objects from the legacy flat objects dir into fan-out subdirectories
+func cmdMigrateObjects() {
+	dirEntries, err := os.ReadDir(OBJECTS_PATH)
+	if err != nil {
+		panic(err)
 	}
 
-	currentBowl := getBowl()
-	head := getFlush(args[0])
-	fmt.Println("Head is " + head.Object.Hash)
-	tree := getTree(head.TreeHash)
-	newBowl := tree.ToBowl()
-
-	deleteWdFiles(currentBowl)
-	writeTreeToWd("./", tree)
-	writeBowl(newBowl)
+	migrated := 0
+	for _, dirEntry := range dirEntries {
+		hash := dirEntry.Name()
+		if !dirEntry.Type().IsRegular() || !isObjectName(hash) {
+			continue
+		}
+		legacyPath := legacyObjectPath(hash)
+		if _, err := os.Stat(objectPath(hash)); err == nil {
+			// Already present in the new layout, the legacy copy is redundant
+			err = os.Remove(legacyPath)
+		} else {
+			err = os.Rename(legacyPath, createObjectDir(hash))
+		}
+		if err != nil {
+			panic(err)
+		}
+		migrated++
+	}
 
-	fmt.Println("Plunged out " + head.Object.Hash)
+	fmt.Printf("Migrated %d objects\n", migrated)
 }
 
 func dirIsTracked() bool {
@@ -321,22 +579,6 @@ func checkInit(action string) {
 	}
 }
 
-func writeTreeToWd(root string, tree Tree) {
-	for _, node := range tree.Nodes {
-		if node.NodeType == "file" {
-			object := getObject(node.Hash)
-			filename := filepath.Join(root, node.Name)
-			os.WriteFile(filename, object.Bytes, 0644)
-		}
-		if node.NodeType == "tree" {
-			subtree := getObject(node.Hash).ToTree()
-			dirname := filepath.Join(root, node.Name)
-			os.Mkdir(dirname, 0644)
-			writeTreeToWd(dirname, subtree)
-		}
-	}
-}
-
 func deleteWdFiles(bowl []BowlEntry) {
 	for _, bowlEntry := range bowl {
 		pathParts := strings.Split(bowlEntry.Path, string(filepath.Separator))
@@ -382,12 +624,140 @@ func getRefFlush(ref string) *Flush {
 	if err != nil {
 		return nil
 	}
-	refFile, err := os.ReadFile(refPath)
+	flush := getFlush(readRef(ref))
+	return &flush
+}
+
+func readRef(ref string) string {
+	refFile, err := os.ReadFile(filepath.Join(REFS_PATH, ref))
 	if err != nil {
 		panic(err)
 	}
-	flush := getFlush(string(refFile))
-	return &flush
+	return strings.TrimSpace(string(refFile))
+}
+
+type RefConflictError struct {
+	Ref      string
+	Expected string
+	Actual   string
+}
+
+func (err *RefConflictError) Error() string {
+	return fmt.Sprintf("Ref %s was expected to point at %q but points at %q, it may have been updated by another shit process", err.Ref, err.Expected, err.Actual)
+}
+
+// Updates a ref from oldHash to newHash and records the update in the reflog.
+// The update is done under a lock file, and fails with a RefConflictError if
+// the ref no longer points at oldHash. An empty oldHash expects the ref not to
+// exist yet.
+func updateRef(ref string, oldHash string, newHash string, message string) error {
+	refPath := filepath.Join(REFS_PATH, ref)
+	err := os.MkdirAll(filepath.Dir(refPath), 0775)
+	if err != nil {
+		return err
+	}
+	lock, err := acquireLock(refPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	var currentHash string
+	if _, err := os.Stat(refPath); err == nil {
+		currentHash = readRef(ref)
+	}
+	if currentHash != oldHash {
+		return &RefConflictError{Ref: ref, Expected: oldHash, Actual: currentHash}
+	}
+
+	lock.Commit(bytes.NewBufferString(newHash))
+	appendReflog(ref, oldHash, newHash, message)
+	return nil
+}
+
+type ReflogEntry struct {
+	OldHash string
+	NewHash string
+	Time    int64 // Seconds since epoch
+	Message string
+}
+
+// Records an update of a ref in its reflog at .shit/logs/<ref>. Each line
+// holds the old and new hash, the time of the update and a message.
+func appendReflog(ref string, oldHash string, newHash string, message string) {
+	if oldHash == "" {
+		oldHash = strings.Repeat("0", len(newHash))
+	}
+	logPath := filepath.Join(LOGS_PATH, ref)
+	err := os.MkdirAll(filepath.Dir(logPath), 0775)
+	if err != nil {
+		panic(err)
+	}
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s %d %s\n", oldHash, newHash, time.Now().Unix(), message)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Replaces the entries of a reflog, e.g. to drop an entry
+func writeReflog(ref string, entries []ReflogEntry) {
+	buf := new(bytes.Buffer)
+	for _, entry := range entries {
+		fmt.Fprintf(buf, "%s %s %d %s\n", entry.OldHash, entry.NewHash, entry.Time, entry.Message)
+	}
+	writeFile(filepath.Join(LOGS_PATH, ref), buf)
+}
+
+// Returns the entries of a reflog, oldest first
+func readReflog(ref string) []ReflogEntry {
+	entries := []ReflogEntry{}
+	logFile, err := os.ReadFile(filepath.Join(LOGS_PATH, ref))
+	if os.IsNotExist(err) {
+		return entries
+	}
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range strings.Split(string(logFile), "\n") {
+		parts := strings.SplitN(line, " ", 4)
+		if len(parts) < 4 {
+			continue
+		}
+		logTime, _ := strconv.ParseInt(parts[2], 10, 64)
+		entries = append(entries, ReflogEntry{OldHash: parts[0], NewHash: parts[1], Time: logTime, Message: parts[3]})
+	}
+	return entries
+}
+
+// Names of all refs, relative to the refs dir
+func listRefs() []string {
+	return listFilesIn(REFS_PATH)
+}
+
+// Names of all refs that have a reflog, relative to the logs dir
+func listReflogs() []string {
+	return listFilesIn(LOGS_PATH)
+}
+
+func listFilesIn(root string) []string {
+	files := []string{}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Skip lock files and temp files left behind by an interrupted write
+		if d.Type().IsRegular() && !strings.HasSuffix(path, ".lock") && !strings.HasPrefix(d.Name(), ".") {
+			relPath, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	return files
 }
 
 func getHead() *Flush {
@@ -404,68 +774,106 @@ func getFlush(hash string) Flush {
 	return object.ToFlush()
 }
 
-func createFlush(tree Tree, parent *Flush, message string) {
+// Writes a flush of the tree on the parent and points HEAD at it. Returns the
+// hash of the flush.
+func createFlush(tree Tree, parent *Flush, author string, message string) string {
 	var parentHash string
 	if parent != nil {
 		parentHash = parent.Object.Hash
 	}
-
-	content := fmt.Sprintf(`tree %s
-parent %s
-time %s
-
-%s
-`, tree.Object.Hash, parentHash, time.Now().UTC().String(), message)
-	flush := createObject("flush", content)
+	flush := createFlushObject(tree.Object.Hash, parentHash, author, message)
 
 	// Update head
 	headRef := getHeadRef()
-	headRefPath := filepath.Join(REFS_PATH, headRef)
-	err := os.WriteFile(headRefPath, []byte(flush.Hash), 0644)
+	summary, _, _ := strings.Cut(message, "\n")
+	err := updateRef(headRef, parentHash, flush.Hash, "flush: "+summary)
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Println("Created flush " + flush.Hash)
+	return flush.Hash
 }
 
-func findNode(tree Tree, path string) *Object {
-	parts := strings.Split(path, string(filepath.Separator))
+// Replaces the HEAD flush with a flush of the tree on the same parent, keeping
+// its author. Returns the hash of the new flush.
+func amendFlush(tree Tree, head *Flush, message string) string {
+	flush := createFlushObject(tree.Object.Hash, head.ParentHash, head.Author, message)
 
-	if len(parts) > 1 {
-		// Look for a tree
-		dir := parts[0]
-		for _, node := range tree.Nodes {
-			if node.Name == dir {
-				nodeObject := getObject(node.Hash)
-				if nodeObject.Header.ObjectType != "tree" {
-					return nil
-				}
-				childPath := strings.Join(parts[1:], string(filepath.Separator))
-				return findNode(nodeObject.ToTree(), childPath)
-			}
+	summary, _, _ := strings.Cut(message, "\n")
+	err := updateRef(getHeadRef(), head.Object.Hash, flush.Hash, "flush (amend): "+summary)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Created flush " + flush.Hash)
+	return flush.Hash
+}
+
+// Writes a flush object without updating any ref. The author header is left
+// out if the author is empty.
+func createFlushObject(treeHash string, parentHash string, author string, message string) Object {
+	headers := fmt.Sprintf("tree %s\nparent %s\ntime %s\n", treeHash, parentHash, time.Now().UTC().String())
+	if author != "" {
+		headers += "author " + author + "\n"
+	}
+	return createObject("flush", headers+"\n"+message+"\n")
+}
+
+// Returns the author from the user.name and user.email config, formatted as
+// "name <email>"
+func flushAuthor() string {
+	config := getConfig()
+	name := config.Get("user.name", "")
+	email := config.Get("user.email", "")
+	if email == "" {
+		return name
+	}
+	return strings.TrimSpace(name + " <" + email + ">")
+}
+
+// Returns the object of a file in a tree, or nil if the tree has no such file.
+// Files in subdirectories are in a subtree named after their whole directory
+// path with a trailing slash, such as "a/b/".
+func findNode(tree Tree, path string) *Object {
+	dir, file := filepath.Split(filepath.Clean(path))
+	if dir != "" {
+		subtree := findTreeNode(tree, dir)
+		if subtree == nil {
+			return nil
 		}
-	} else {
-		// Look for a file
-		fileName := parts[0]
-		for _, node := range tree.Nodes {
-			if node.Name == fileName {
-				nodeObject := getObject(node.Hash)
-				return &nodeObject
-			}
+		tree = getObject(subtree.Hash).ToTree()
+	}
+	for _, node := range tree.Nodes {
+		if node.Name == file && node.IsFile() {
+			nodeObject := getObject(node.Hash)
+			return &nodeObject
 		}
 	}
+	return nil
+}
 
+func findTreeNode(tree Tree, name string) *TreeNode {
+	for _, node := range tree.Nodes {
+		if node.Name == name && node.NodeType == "tree" {
+			return &node
+		}
+	}
 	return nil
 }
 
 func getBowl() []BowlEntry {
 	bowlFile := readFile(BOWL_PATH)
+	if strings.HasPrefix(bowlFile, BOWL_INDEX_MAGIC) {
+		return decodeBowlIndex([]byte(bowlFile))
+	}
+
 	bowlLines := strings.Split(bowlFile, "\n")
 	var bowl []BowlEntry
 
-	if bowlLines[0] == "" {
-		return bowl
+	legacy := bowlLines[0] != BOWL_HEADER
+	if !legacy {
+		bowlLines = bowlLines[1:]
 	}
 
 	for _, line := range bowlLines {
@@ -473,18 +881,41 @@ func getBowl() []BowlEntry {
 			continue
 		}
 
-		cleaned := strings.TrimSpace(line)
-		cleaned = strings.Trim(line, "\"\r\n")
-
-		lineParts := strings.Split(cleaned, " ")
-		hash := lineParts[0]
-		path := lineParts[1]
-		object := getObject(hash)
-		bowl = append(bowl, BowlEntry{Object: object, Path: path})
+		var hash, path string
+		if legacy {
+			hash, path = parseLegacyBowlLine(line)
+		} else {
+			hash, path, _ = strings.Cut(line, " ")
+			path = unquotePath(path)
+		}
+		bowl = append(bowl, BowlEntry{Hash: hash, Path: path})
 	}
 	return bowl
 }
 
+func getBowlMtime() int64 {
+	info, err := os.Stat(BOWL_PATH)
+	if err != nil {
+		panic(err)
+	}
+	return info.ModTime().UnixNano()
+}
+
+// A file is unchanged if its stat data matches the bowl entry. Files modified
+// after the bowl was last written are treated as changed, since a change made
+// within the timestamp granularity of the filesystem would otherwise go unseen.
+func statUnchanged(bowlStat FileStat, wdStat FileStat, bowlMtime int64) bool {
+	return bowlStat == wdStat && wdStat.Mtime < bowlMtime
+}
+
+// Parses a line from a bowl written before paths were quoted. Everything after
+// the first space is the path, so paths containing spaces are still recovered.
+func parseLegacyBowlLine(line string) (string, string) {
+	cleaned := strings.Trim(line, "\"\r\n")
+	hash, path, _ := strings.Cut(cleaned, " ")
+	return hash, path
+}
+
 func addToBowl(bowl []BowlEntry, newEntries ...BowlEntry) []BowlEntry {
 	var newBowl []BowlEntry
 
@@ -504,38 +935,218 @@ func addToBowl(bowl []BowlEntry, newEntries ...BowlEntry) []BowlEntry {
 	return newBowl
 }
 
-func removeFromBowl(bowl []BowlEntry, path string) []BowlEntry {
-	var newBowl []BowlEntry
+// Writes the bowl through the lock taken with lockBowl before it was read
+func writeBowl(lock *LockFile, bowl []BowlEntry) {
+	slices.SortFunc(bowl, func(a, b BowlEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	lock.Commit(encodeBowlIndex(bowl))
+}
+
+// Encodes the bowl as a binary index:
+//
+//	magic "SBWL" | version uint32 | entry count uint32
+//
+// followed by one record per entry:
+//
+//	ctime int64 | mtime int64 | size int64 | inode uint64 | mode uint32 |
+//	hash length uint8 | hash | path length uint16 | path
+//
+// All integers are big endian, the hash is stored as raw bytes.
+func encodeBowlIndex(bowl []BowlEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.WriteString(BOWL_INDEX_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint32(BOWL_INDEX_VERSION))
+	binary.Write(buf, binary.BigEndian, uint32(len(bowl)))
+
 	for _, entry := range bowl {
-		if entry.Path != path {
-			newBowl = append(newBowl, entry)
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			panic(err)
 		}
+		binary.Write(buf, binary.BigEndian, entry.Stat)
+		buf.WriteByte(byte(len(hash)))
+		buf.Write(hash)
+		binary.Write(buf, binary.BigEndian, uint16(len(entry.Path)))
+		buf.WriteString(entry.Path)
 	}
-	return newBowl
+	return buf
 }
 
-func writeBowl(bowl []BowlEntry) {
-	slices.SortFunc(bowl, func(a, b BowlEntry) int {
-		return strings.Compare(a.Path, b.Path)
-	})
+func decodeBowlIndex(index []byte) []BowlEntry {
+	reader := bytes.NewReader(index[len(BOWL_INDEX_MAGIC):])
+	read := func(data any) {
+		err := binary.Read(reader, binary.BigEndian, data)
+		if err != nil {
+			panic(fmt.Sprintf("Bowl index is corrupt: %s", err))
+		}
+	}
 
-	var bowlLines []string
-	for _, bowlEntry := range bowl {
-		bowlLines = append(bowlLines, fmt.Sprintf("%s %s", bowlEntry.Object.Hash, bowlEntry.Path))
+	var version, count uint32
+	read(&version)
+	if version != BOWL_INDEX_VERSION {
+		panic(fmt.Sprintf("Unsupported bowl index version %d", version))
 	}
+	read(&count)
 
-	content := strings.Join(bowlLines, "\n")
-	buf := bytes.NewBuffer([]byte(content))
-	writeFile(BOWL_PATH, buf)
+	var bowl []BowlEntry
+	for i := uint32(0); i < count; i++ {
+		var entry BowlEntry
+		var hashLen uint8
+		var pathLen uint16
+		read(&entry.Stat)
+		read(&hashLen)
+		hash := make([]byte, hashLen)
+		read(hash)
+		read(&pathLen)
+		path := make([]byte, pathLen)
+		read(path)
+		entry.Hash = hex.EncodeToString(hash)
+		if !isObjectName(entry.Hash) {
+			panic(fmt.Sprintf("Bowl entry %s has hash %s, expected a %s hash", path, entry.Hash, objectFormat()))
+		}
+		entry.Path = string(path)
+		bowl = append(bowl, entry)
+	}
+	return bowl
+}
+
+// Objects are stored in subdirectories named after the first two characters
+// of their hash, e.g. .shit/objects/19/7fa33f64bfce7ac12607ad567ea8573a38a823
+func objectPath(hash string) string {
+	return filepath.Join(OBJECTS_PATH, hash[:2], hash[2:])
+}
+
+// Path of an object written before objects were fanned out into subdirectories
+func legacyObjectPath(hash string) string {
+	return filepath.Join(OBJECTS_PATH, hash)
+}
+
+// Returns the path an object is stored at, falling back to the legacy flat
+// layout for repositories that have not been migrated
+func findObjectPath(hash string) string {
+	if !isObjectName(hash) {
+		panic(fmt.Sprintf("Invalid object name %s, expected a %s hash", hash, objectFormat()))
+	}
+	path := objectPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	legacyPath := legacyObjectPath(hash)
+	if _, err := os.Stat(legacyPath); err == nil {
+		return legacyPath
+	}
+	return path
+}
+
+// Creates the fan-out directory of an object and returns the object path
+func createObjectDir(hash string) string {
+	path := objectPath(hash)
+	err := os.MkdirAll(filepath.Dir(path), 0775)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// Objects known to exist, cached per invocation so that objects written or
+// looked up once are not looked up on disk again
+var knownObjects = make(map[string]bool)
+var knownObjectsMutex sync.Mutex
+
+func resetKnownObjects() {
+	knownObjectsMutex.Lock()
+	defer knownObjectsMutex.Unlock()
+	knownObjects = make(map[string]bool)
+}
+
+func setObjectKnown(hash string, known bool) {
+	knownObjectsMutex.Lock()
+	defer knownObjectsMutex.Unlock()
+	if known {
+		knownObjects[hash] = true
+	} else {
+		delete(knownObjects, hash)
+	}
+}
+
+func objectExists(hash string) bool {
+	knownObjectsMutex.Lock()
+	known := knownObjects[hash]
+	knownObjectsMutex.Unlock()
+	if known {
+		return true
+	}
+
+	found := false
+	if _, err := os.Stat(findObjectPath(hash)); err == nil {
+		found = true
+	} else {
+		_, _, found = findPackedObject(hash)
+	}
+	if found {
+		setObjectKnown(hash, true)
+	}
+	return found
+}
+
+// Hashes of all loose objects, in both the fan-out and the legacy layout
+func listLooseObjects() []string {
+	hashes := []string{}
+	dirEntries, err := os.ReadDir(OBJECTS_PATH)
+	if err != nil {
+		panic(err)
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.Type().IsRegular() && isObjectName(name) {
+			hashes = append(hashes, name)
+		}
+		if !dirEntry.IsDir() || len(name) != 2 {
+			continue
+		}
+		subEntries, err := os.ReadDir(filepath.Join(OBJECTS_PATH, name))
+		if err != nil {
+			panic(err)
+		}
+		for _, subEntry := range subEntries {
+			if subEntry.Type().IsRegular() && isObjectName(name+subEntry.Name()) {
+				hashes = append(hashes, name+subEntry.Name())
+			}
+		}
+	}
+	slices.Sort(hashes)
+	return slices.Compact(hashes)
+}
+
+// Removes a loose object, and its fan-out directory if it is left empty
+func removeLooseObject(hash string) {
+	for _, path := range []string{objectPath(hash), legacyObjectPath(hash)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+	os.Remove(filepath.Dir(objectPath(hash))) // Fails if the directory is not empty
+	setObjectKnown(hash, false)
+}
+
+// Object names are hex encoded hashes in the object format of the repository
+func isObjectName(name string) bool {
+	if len(name) != newHasher().Size()*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
 }
 
 func getObject(hash string) Object {
-	var objectPath = fmt.Sprintf(OBJECTS_PATH+"/%s", hash)
-	var reader, err = os.Open(objectPath)
+	reader := openRawObject(hash)
+	defer reader.Close()
+	objectBytes, err := io.ReadAll(reader)
 	if err != nil {
 		panic(err)
 	}
-	objectBytes := decompress(reader)
 	header := getHeader(objectBytes)
 	contentBytes := objectBytes[header.Len:]
 	content := string(contentBytes)
@@ -543,12 +1154,117 @@ func getObject(hash string) Object {
 
 }
 
+// Opens an object for reading. The content is decompressed lazily as the
+// returned reader is consumed, which must be closed by the caller.
+func openObject(hash string) (Header, io.ReadCloser) {
+	raw := openRawObject(hash)
+	buffered := bufio.NewReader(raw)
+	reader := &objectReader{Reader: buffered, closers: []io.Closer{raw}}
+
+	objectType, err := buffered.ReadString('\n')
+	if err != nil {
+		reader.Close()
+		panic(fmt.Sprintf("Object %s has a malformed header", hash))
+	}
+	blank, err := buffered.ReadString('\n')
+	if err != nil || blank != "\n" {
+		reader.Close()
+		panic(fmt.Sprintf("Object %s has a malformed header", hash))
+	}
+
+	headerContent := objectType + blank
+	header := Header{ObjectType: strings.TrimSuffix(objectType, "\n"), Len: len(headerContent), Content: headerContent}
+	return header, reader
+}
+
+// Opens the decompressed bytes of an object, including the header, from either
+// a loose object file or a pack
+//
+// Objects up to core.verifyMaxSize bytes as stored (16 MiB by default, 0 for
+// no limit) are verified against their hash as they are read, unless
+// core.verifyObjects is false. A corrupt object makes the reader fail with a
+// CorruptObjectError once its end is reached.
+func openRawObject(hash string) io.ReadCloser {
+	reader, storedSize := openStoredObject(hash)
+	config := getConfig()
+	maxSize := config.GetInt("core.verifyMaxSize", DEFAULT_VERIFY_MAX_SIZE)
+	if !config.GetBool("core.verifyObjects", true) || (maxSize > 0 && storedSize > maxSize) {
+		return reader
+	}
+	return &verifyingReader{ReadCloser: reader, hash: hash, hasher: newHasher()}
+}
+
+const DEFAULT_VERIFY_MAX_SIZE = 16 * 1024 * 1024
+
+// Opens the decompressed bytes of an object without verifying them, and
+// returns the size of the object as stored
+func openStoredObject(hash string) (io.ReadCloser, int64) {
+	path := findObjectPath(hash)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		pack, offset, found := findPackedObject(hash)
+		if !found {
+			panic(fmt.Sprintf("Object %s not found", hash))
+		}
+		return pack.openObject(offset), storedObjectSize(hash)
+	}
+	if err != nil {
+		panic(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		panic(err)
+	}
+	decompressed, err := newDecompressor(file)
+	if err != nil {
+		file.Close()
+		panic(err)
+	}
+	return &objectReader{Reader: decompressed, closers: []io.Closer{decompressed, file}}, info.Size()
+}
+
+type objectReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (reader *objectReader) Close() error {
+	var err error
+	for _, closer := range reader.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Streams the content of an object to a file in the workdir. The content is
+// written to a temp file first, so the file is left untouched if the object
+// turns out to be corrupt.
+func writeObjectToFile(hash string, path string, mode os.FileMode) {
+	_, reader := openObject(hash)
+	defer reader.Close()
+	writeTempFile(filepath.Dir(path), ".shit_tmp_", mode, func(file *os.File) string {
+		_, err := io.Copy(file, reader)
+		if err != nil {
+			panic(err)
+		}
+		return path
+	})
+}
+
 func createObject(objectType string, content string) Object {
 	header, bytes := addHeader(objectType, content)
 	hash := hash(bytes)
-	objectPath := fmt.Sprintf(OBJECTS_PATH+"/%s", hash)
+	object := Object{Hash: hash, Header: header, Bytes: bytes}
+	if objectExists(hash) {
+		return object
+	}
+	objectPath := createObjectDir(hash)
 	writeFile(objectPath, compress(bytes))
-	return Object{Hash: hash, Header: header, Bytes: bytes}
+	setObjectKnown(hash, true)
+	return object
 }
 
 func getHeader(object []byte) Header {
@@ -570,6 +1286,51 @@ func getHeader(object []byte) Header {
 	return Header{ObjectType: headerLines[0], Len: headerLen}
 }
 
+// Creates an object by streaming its content from a reader. The content is
+// hashed and compressed in a single pass into a temp file, which is renamed
+// into the objects dir once the hash is known.
+func createObjectFromReader(objectType string, reader io.Reader) Object {
+	return writeObjectFromReader(objectType, reader, false)
+}
+
+// Streams an object into a loose object file. Unless force is set, nothing is
+// written if the object already exists, loose or packed.
+func writeObjectFromReader(objectType string, reader io.Reader, force bool) Object {
+	header, headerBytes := addHeader(objectType, "")
+
+	hash := ""
+	written := false
+	writeTempFile(OBJECTS_PATH, "tmp_obj_", 0644, func(tmp *os.File) string {
+		hasher := newHasher()
+		compressor := newCompressor(tmp)
+		w := io.MultiWriter(hasher, compressor)
+
+		_, err := w.Write(headerBytes)
+		if err != nil {
+			panic(err)
+		}
+		_, err = io.Copy(w, reader)
+		if err != nil {
+			panic(err)
+		}
+		err = compressor.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		hash = hex.EncodeToString(hasher.Sum(nil))
+		if !force && objectExists(hash) {
+			return "" // The temp file is discarded
+		}
+		written = true
+		return createObjectDir(hash)
+	})
+	if written {
+		setObjectKnown(hash, true)
+	}
+	return Object{Hash: hash, Header: header}
+}
+
 // Returns the header, and a byte array containing the full object content including the header
 func addHeader(objectType string, objectContent string) (Header, []byte) {
 	headerContent := objectType + "\n\n"
@@ -590,7 +1351,11 @@ func createTree(bowlEntries []BowlEntry) Tree {
 	for _, bowlEntry := range bowlEntries {
 		dir, file := filepath.Split(bowlEntry.Path)
 		if dir == "" {
-			nodes = append(nodes, TreeNode{Name: file, NodeType: "file", Hash: bowlEntry.Object.Hash})
+			nodeType := "file"
+			if isExecutable(bowlEntry.Mode()) {
+				nodeType = "exec"
+			}
+			nodes = append(nodes, TreeNode{Name: file, NodeType: nodeType, Hash: bowlEntry.Hash})
 		} else {
 			bowlEntry.Path = file
 			bowlSubentryMap[dir] = append(bowlSubentryMap[dir], bowlEntry)
@@ -610,12 +1375,35 @@ func createTree(bowlEntries []BowlEntry) Tree {
 
 	treeEntries := []string{}
 	for _, treeNode := range nodes {
-		treeEntries = append(treeEntries, fmt.Sprintf("%s %s %s", treeNode.NodeType, treeNode.Hash, treeNode.Name))
+		treeEntries = append(treeEntries, fmt.Sprintf("%s %s %s", treeNode.NodeType, treeNode.Hash, quotePath(treeNode.Name)))
 	}
 	var object = createObject("tree", strings.Join(treeEntries, "\n"))
 	return object.ToTree()
 }
 
+// Quotes a path for the bowl and tree formats if it contains spaces, quotes,
+// backslashes or non-printable characters. Other paths are written as is, so
+// trees without such paths hash the same as before quoting was introduced.
+func quotePath(path string) string {
+	for _, c := range path {
+		if c == '"' || c == '\\' || unicode.IsSpace(c) || !unicode.IsPrint(c) {
+			return strconv.Quote(path)
+		}
+	}
+	return path
+}
+
+func unquotePath(path string) string {
+	if !strings.HasPrefix(path, "\"") {
+		return path
+	}
+	unquoted, err := strconv.Unquote(path)
+	if err != nil {
+		panic(fmt.Sprintf("Malformed quoted path %s", path))
+	}
+	return unquoted
+}
+
 func readFile(path string) string {
 	var bytes, err = os.ReadFile(path)
 	if err != nil {
@@ -624,52 +1412,102 @@ func readFile(path string) string {
 	return string(bytes)
 }
 
+// Writes a file atomically. The content is written to a temp file in the same
+// directory, synced to disk and renamed over the destination, so neither
+// readers nor a crash can observe a partially written file.
 func writeFile(path string, buf *bytes.Buffer) {
-	file, err := os.Create(path)
+	writeTempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp_", 0644, func(file *os.File) string {
+		_, err := io.Copy(file, buf)
+		if err != nil {
+			panic(err)
+		}
+		return path
+	})
+}
+
+// Creates a temp file in dir for write to fill, and commits it with the mode
+// to the path that write returns. The temp file is removed instead if write
+// returns an empty path or panics.
+func writeTempFile(dir string, pattern string, mode os.FileMode, write func(file *os.File) string) {
+	file, err := os.CreateTemp(dir, pattern)
 	if err != nil {
 		panic(err)
 	}
+	defer os.Remove(file.Name()) // Fails silently once the temp file has been renamed
 	defer file.Close()
-	_, err = io.Copy(file, buf)
+	if path := write(file); path != "" {
+		commitFile(file, path, mode)
+	}
+}
+
+// Syncs and closes a temp file and renames it to path
+func commitFile(file *os.File, path string, mode os.FileMode) {
+	err := file.Chmod(mode)
+	if err != nil {
+		panic(err)
+	}
+	err = file.Sync()
+	if err != nil {
+		panic(err)
+	}
+	err = file.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = os.Rename(file.Name(), path)
 	if err != nil {
 		panic(err)
 	}
+	syncDir(filepath.Dir(path))
+}
+
+// Syncs a directory so that a rename into it survives a crash. Not all
+// platforms support syncing directories, so errors are ignored.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
 }
 
 func hash(bytes []byte) string {
-	hasher := sha1.New()
+	hasher := newHasher()
 	hasher.Write(bytes)
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-func compress(b []byte) *bytes.Buffer {
-	var buf = new(bytes.Buffer)
-	w := zlib.NewWriter(buf)
-	w.Write(b)
-	w.Close()
-	return buf
-}
-
-func decompress(r io.Reader) []byte {
-	decompressed, err := zlib.NewReader(r)
-	if err != nil {
-		panic(err)
-	}
-	var buf = new(bytes.Buffer)
-	buf.ReadFrom(decompressed)
-	decompressed.Close()
-	return buf.Bytes()
-}
-
 func exitUsage() {
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 	fmt.Fprint(w, "Usage:\n\n"+
-		"shit init\tInitialize Shit repository\n"+
+		"shit init [--object-format=sha1|sha256]\tInitialize Shit repository\n"+
 		"shit add <filename>\tAdd a file to the the bowl\n"+
 		"shit sniff\tShow the current status of the bowl\n"+
 		"shit log\tShow the flush logs\n"+
-		"shit flush -m <message>\tWrite the current bowl to a flush\n"+
-		"shit plunge <hash>\tPlunge out a specific flush\n")
+		"shit flush [-m <message>|-F <file>]\tWrite the current bowl to a flush, the message is edited in $SHIT_EDITOR or $EDITOR if none is given\n"+
+		"shit flush --amend [-m <message>|-F <file>]\tReplace the HEAD flush with a flush of the current bowl, keeping its message unless one is given\n"+
+		"shit plunge [--force|--merge] <hash>\tPlunge out a specific flush, --force discards and --merge merges conflicting local changes\n"+
+		"shit migrate-objects\tMove objects into the fan-out directory layout\n"+
+		"shit pack\tPack loose objects into a pack file\n"+
+		"shit gc [--dry-run] [--expire=<duration>]\tPrune unreachable objects and repack all objects into a single pack file\n"+
+		"shit prune [--dry-run] [--expire=<duration>]\tRemove unreachable loose objects older than the expiry (default 336h)\n"+
+		"shit fsck\tVerify the integrity of all objects\n"+
+		"shit config <key> [<value>]\tGet or set a repository config value\n"+
+		"shit stash [push [-m <message>]]\tStash the local changes of the bowl and workdir\n"+
+		"shit stash apply|pop [stash@{<n>}]\tRestore stashed changes, pop also drops the stash entry\n"+
+		"shit stash list|show|drop [stash@{<n>}]\tList, show or drop stash entries\n"+
+		"shit cherry-pick <rev>...\tApply the changes of existing flushes as new flushes on HEAD\n"+
+		"shit cherry-pick --continue|--skip|--abort\tContinue a cherry-pick stopped by conflicts, skip the stopped flush, or abort it\n"+
+		"shit revert <rev>...\tCreate flushes undoing the changes of existing flushes\n"+
+		"shit revert --continue|--skip|--abort\tContinue a revert stopped by conflicts, skip the stopped flush, or abort it\n"+
+		"shit rebase [-i|--interactive] <upstream>\tReplay the flushes of the current branch on top of <upstream>, -i edits the list of flushes first\n"+
+		"shit rebase --continue|--skip|--abort\tContinue a rebase stopped by conflicts, skip the stopped flush, or abort it\n"+
+		"shit blame [-L <start>,<end>] <path>\tShow the flush, author and date that last changed each line of a file\n"+
+		"\nA <rev> is HEAD, a ref name, a flush hash or a unique prefix of one, optionally\n"+
+		"followed by ~<n> to select its n-th parent.\n"+
+		"\nExecutables in .shit/hooks named pre-flush, flush-msg, post-flush, pre-plunge\n"+
+		"and post-plunge are run around flush and plunge, a failing pre-hook aborts.\n")
 	w.Flush()
 	os.Exit(0)
 }
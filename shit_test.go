@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var files = []string{}
@@ -65,6 +69,37 @@ be12174911e3aae8c2ed6ef5cb66b32893b3bd21 file2.txt
 
 }
 
+func TestAddAllParallel(t *testing.T) {
+	initt(t)
+
+	expectedBowl := ""
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("dir%d/file%03d.txt", i%3, i)
+		fileFixture(path, fmt.Sprintf("File %d", i%50))
+	}
+	for i := 0; i < 3; i++ {
+		for j := i; j < 200; j += 3 {
+			contentHash := hash([]byte(fmt.Sprintf("file\n\nFile %d", j%50)))
+			expectedBowl += fmt.Sprintf("%s dir%d/file%03d.txt\n", contentHash, i, j)
+		}
+	}
+
+	// Objects that already exist are not rewritten
+	existing := createObject("file", "File 0")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(objectPath(existing.Hash), past, past)
+
+	run("add", "-A")
+	output := run("sniff")
+	assert(t, output, expectedBowl)
+	assertInt(t, len(listLooseObjects()), 50)
+
+	info, _ := os.Stat(objectPath(existing.Hash))
+	if !info.ModTime().Equal(past) {
+		t.Error("Existing object was rewritten")
+	}
+}
+
 // Test removing a file from worktree, running add -A, expecting the removed file to be removed from the bowl, finally
 func TestRemoveFromBowl(t *testing.T) {
 	initt(t)
@@ -91,12 +126,122 @@ be12174911e3aae8c2ed6ef5cb66b32893b3bd21 file2.txt
 	assert(t, output, expectedBowl)
 }
 
+func TestPathsWithSpecialCharacters(t *testing.T) {
+	initt(t)
+
+	fileFixture("my notes.txt", "A test")                   // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	fileFixture("dir with space/\"quoted\"\tfile", "Hello") // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+
+	run("add", "-A")
+
+	output := run("sniff")
+	assert(t, output, `be12174911e3aae8c2ed6ef5cb66b32893b3bd21 "dir with space/\"quoted\"\tfile"
+c4a5964fd224738514ccd7354a45d37a5ef1a8b3 "my notes.txt"
+`)
+
+	output = run("flush", "-m", "A flush")
+	flush := getFlush(hashFromFlushOutput(output))
+	tree := getTree(flush.TreeHash)
+
+	assertInt(t, len(tree.Nodes), 2)
+	assert(t, tree.Nodes[0].Name, "dir with space/")
+	assert(t, tree.Nodes[1].Name, "my notes.txt")
+	assert(t, getObject(tree.Nodes[0].Hash).ToTree().Nodes[0].Name, "\"quoted\"\tfile")
+}
+
+func TestMigrateLegacyBowl(t *testing.T) {
+	initt(t)
+
+	objectFixture("file\n\nA test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	fileFixture(".shit/bowl", `c4a5964fd224738514ccd7354a45d37a5ef1a8b3 file1.txt
+c4a5964fd224738514ccd7354a45d37a5ef1a8b3 my notes.txt
+`)
+
+	fileFixture("file2.txt", "Hello") // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+	run("add", "file2.txt")
+
+	assert(t, getFile(".shit/bowl")[:4], "SBWL")
+	output := run("sniff")
+	assert(t, output, `c4a5964fd224738514ccd7354a45d37a5ef1a8b3 file1.txt
+be12174911e3aae8c2ed6ef5cb66b32893b3bd21 file2.txt
+c4a5964fd224738514ccd7354a45d37a5ef1a8b3 "my notes.txt"
+`)
+}
+
+// Test that add -A only rehashes files whose stat data changed since they were added
+func TestAddSkipsUnchangedFiles(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes("file1.txt", past, past)
+	run("add", "-A")
+
+	// Unchanged file is not rehashed, so its object is not recreated
+	os.Remove(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3"))
+	run("add", "-A")
+	if _, err := os.Stat(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3")); err == nil {
+		t.Error("Unchanged file was rehashed")
+	}
+
+	// Changed file is rehashed
+	fileFixture("file1.txt", "Hello") // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+	run("add", "-A")
+	output := run("sniff")
+	assert(t, output, "be12174911e3aae8c2ed6ef5cb66b32893b3bd21 file1.txt\n")
+}
+
 func TestCreateObject(t *testing.T) {
 	initt(t)
 	createObject("file", "A test file\nWith two lines\n")
 	assertObject(t, "197fa33f64bfce7ac12607ad567ea8573a38a823", "file\n\nA test file\nWith two lines\n")
 }
 
+func TestCreateObjectFromReader(t *testing.T) {
+	initt(t)
+	content := "A test file\nWith two lines\n"
+	object := createObjectFromReader("file", strings.NewReader(content))
+	assert(t, object.Hash, "197fa33f64bfce7ac12607ad567ea8573a38a823")
+	assertObject(t, object.Hash, "file\n\n"+content)
+
+	// Large content is streamed through without changing the hash
+	large := strings.Repeat("A line in a large file\n", 100000)
+	object = createObjectFromReader("file", strings.NewReader(large))
+	assert(t, object.Hash, createObject("file", large).Hash)
+
+	header, reader := openObject(object.Hash)
+	defer reader.Close()
+	assert(t, header.ObjectType, "file")
+	actual, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, len(actual), len(large))
+}
+
+func TestMigrateObjects(t *testing.T) {
+	initt(t)
+
+	// Fixtures are written in the legacy flat layout
+	hash1 := objectFixture("file\n\nA test")
+	hash2 := objectFixture("file\n\nHello")
+	output := run("get-object", hash1)
+	assert(t, output, "file\n\nA test")
+
+	output = run("migrate-objects")
+	assert(t, output, "Migrated 2 objects\n")
+
+	assertObject(t, hash1, "file\n\nA test")
+	assertObject(t, hash2, "file\n\nHello")
+	assertDir(t, ".shit/objects/c4", "a5964fd224738514ccd7354a45d37a5ef1a8b3")
+	if _, err := os.Stat(".shit/objects/" + hash1); err == nil {
+		t.Error("Legacy object was not removed")
+	}
+
+	output = run("migrate-objects")
+	assert(t, output, "Migrated 0 objects\n")
+}
+
 func TestGetObject(t *testing.T) {
 	initt(t)
 
@@ -169,6 +314,132 @@ be12174911e3aae8c2ed6ef5cb66b32893b3bd21 dir1/file4.txt
 	assertLine(t, content, 6, "A flush")
 }
 
+func TestFlushAmend(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "File 1")
+	run("add", "-A")
+	output := run("flush", "-m", "First flush")
+	firstHash := hashFromFlushOutput(output)
+	fileFixture("file2.txt", "File 2")
+	run("add", "-A")
+	output = run("flush", "-m", "Second flush")
+	secondHash := hashFromFlushOutput(output)
+
+	// Without a message the original message is kept
+	fileFixture("file2.txt", "File 2 fixed")
+	run("add", "-A")
+	output = run("flush", "--amend")
+	amendedHash := hashFromFlushOutput(output)
+	amended := getFlush(amendedHash)
+	assert(t, readRef("master"), amendedHash)
+	assert(t, amended.ParentHash, firstHash)
+	assert(t, amended.Message, "Second flush\n")
+	assert(t, findNode(getObject(amended.TreeHash).ToTree(), "file2.txt").Content, "File 2 fixed")
+
+	output = run("flush", "--amend", "-m", "Reworded flush")
+	rewordedHash := hashFromFlushOutput(output)
+	assert(t, getFlush(rewordedHash).ParentHash, firstHash)
+	assert(t, getFlush(rewordedHash).Message, "Reworded flush\n")
+
+	entries := readReflog("master")
+	assert(t, entries[len(entries)-2].OldHash, secondHash)
+	assert(t, entries[len(entries)-2].Message, "flush (amend): Second flush")
+	assert(t, entries[len(entries)-1].OldHash, amendedHash)
+	assert(t, entries[len(entries)-1].NewHash, rewordedHash)
+}
+
+func TestFlushMessageEditor(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "File 1")
+	fileFixture("file2.txt", "File 2")
+	run("add", "-A")
+	run("flush", "-m", "First flush")
+	fileFixture("file1.txt", "File 1 changed")
+	fileFixture("file3.txt", "File 3")
+	os.Remove("file2.txt")
+	run("add", "-A")
+
+	// The editor sees the staged changes, and comments are stripped from the
+	// message it leaves
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	edited := filepath.Join(t.TempDir(), "edited")
+	writeFile(editor, bytes.NewBufferString(`cp "$1" `+edited+`
+printf 'Edited message\n\n# A comment\nMore text\n' > "$1"
+`))
+	t.Setenv("SHIT_EDITOR", "sh "+editor)
+	output := run("flush")
+	assert(t, getFlush(hashFromFlushOutput(output)).Message, "Edited message\n\nMore text\n")
+	assertFile(t, edited, `
+# Please enter the flush message for your changes. Lines starting
+# with '#' are ignored, and an empty message aborts the flush.
+#
+# Changes to be flushed:
+# 	modified:  file1.txt
+# 	deleted:   file2.txt
+# 	new file:  file3.txt
+`)
+
+	t.Setenv("SHIT_EDITOR", "true")
+	assert(t, editFlushMessage(), "")
+
+	messageFile := filepath.Join(t.TempDir(), "message")
+	writeFile(messageFile, bytes.NewBufferString("Message from a file\n\n"))
+	fileFixture("file3.txt", "File 3 changed")
+	run("add", "-A")
+	output = run("flush", "-F", messageFile)
+	assert(t, getFlush(hashFromFlushOutput(output)).Message, "Message from a file\n")
+}
+
+func TestHooks(t *testing.T) {
+	initt(t)
+
+	os.MkdirAll(HOOKS_PATH, 0755)
+	writeHook := func(name string, script string) {
+		err := os.WriteFile(filepath.Join(HOOKS_PATH, name), []byte("#!/bin/sh\n"+script), 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	writeHook("pre-flush", `cat > "$SHIT_DIR/pre-flush-input"; test -e "$SHIT_DIR/bowl.lock" && echo locked >> "$SHIT_DIR/pre-flush-input"`)
+	writeHook("flush-msg", `sed -i 's/^/[T-1] /' "$1"`)
+	writeHook("post-flush", `echo "$SHIT_HOOK $1" > "$SHIT_DIR/post-flush-input"`)
+	writeHook("pre-plunge", `echo "$@" > "$SHIT_DIR/pre-plunge-input"; cat >> "$SHIT_DIR/pre-plunge-input"; test -e "$SHIT_DIR/bowl.lock" && echo locked >> "$SHIT_DIR/pre-plunge-input"`)
+	writeHook("post-plunge", `echo "$@" > "$SHIT_DIR/post-plunge-input"`)
+
+	fileFixture("file1.txt", "File 1")
+	run("add", "-A")
+	output := run("flush", "-m", "A flush")
+	firstHash := hashFromFlushOutput(output)
+	assertFile(t, ".shit/pre-flush-input", "A\tfile1.txt\nlocked\n")
+	assert(t, getFlush(firstHash).Message, "[T-1] A flush\n")
+	assertFile(t, ".shit/post-flush-input", "post-flush "+firstHash+"\n")
+
+	fileFixture("file2.txt", "File 2")
+	run("add", "-A")
+	output = run("flush", "-m", "Another flush")
+	secondHash := hashFromFlushOutput(output)
+
+	run("plunge", firstHash)
+	assertFile(t, ".shit/pre-plunge-input", secondHash+" "+firstHash+"\nD\tfile2.txt\nlocked\n")
+	assertFile(t, ".shit/post-plunge-input", secondHash+" "+firstHash+"\n")
+
+	// A failing hook aborts, and a hook that is not executable is ignored
+	writeHook("pre-flush", "exit 1")
+	assert(t, fmt.Sprint(runHook("pre-flush", nil, nil)), "false")
+	os.Chmod(filepath.Join(HOOKS_PATH, "pre-flush"), 0644)
+	assert(t, fmt.Sprint(runHook("pre-flush", nil, nil)), "true")
+
+	// An unchanged flush message template aborts the flush
+	fileFixture("template", "[T-] \n\nDescription\n")
+	run("config", "flush.template", "template")
+	t.Setenv("SHIT_EDITOR", "true")
+	assert(t, editFlushMessage(), "")
+	t.Setenv("SHIT_EDITOR", `sed -i 's/T-/T-2/'`)
+	assert(t, editFlushMessage(), "[T-2]\n\nDescription")
+}
+
 func TestAddAndFlushMultipleTimes(t *testing.T) {
 	initt(t)
 
@@ -219,6 +490,1012 @@ func TestAddAndFlushMultipleTimes(t *testing.T) {
 	}
 }
 
+func TestPack(t *testing.T) {
+	initt(t)
+
+	// Similar versions of a file should be delta compressed against each other
+	content := strings.Repeat("Some line in a file that changes a little\n", 200)
+	fileFixture("file1.txt", content)
+	run("add", "file1.txt")
+	output := run("flush", "-m", "A flush")
+	firstFlushHash := hashFromFlushOutput(output)
+	fileFixture("file1.txt", content+"A new line\n")
+	run("add", "file1.txt")
+	output = run("flush", "-m", "Another flush")
+	flushHash := hashFromFlushOutput(output)
+
+	loose := listLooseObjects()
+	output = run("pack")
+	assert(t, output, "Packed 6 objects (1 deltas)\n")
+	assertInt(t, len(listLooseObjects()), 0)
+
+	for _, hash := range loose {
+		object := getObject(hash)
+		assert(t, object.Hash, hash)
+	}
+	flush := getFlush(flushHash)
+	tree := getTree(flush.TreeHash)
+	assert(t, getObject(tree.Nodes[0].Hash).Content, content+"A new line\n")
+
+	// Packed objects can be streamed
+	output = run("get-object", tree.Nodes[0].Hash)
+	assert(t, output, "file\n\n"+content+"A new line\n")
+
+	// Plunging reads file contents from the pack
+	run("plunge", firstFlushHash)
+	assertFile(t, "file1.txt", content)
+	run("plunge", flush.Object.Hash)
+	assertFile(t, "file1.txt", content+"A new line\n")
+
+	// The delta size limit applies to the uncompressed size
+	hash := createObject("file", strings.Repeat("A", 1000)).Hash
+	assertInt(t, int(packCandidates([]string{hash})[0].Size), 1006)
+	if storedObjectSize(hash) >= 1006 {
+		t.Error("Expected the stored object to be compressed")
+	}
+}
+
+func TestGc(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "File 1")
+	run("add", "file1.txt")
+	run("flush", "-m", "A flush")
+	run("pack")
+
+	fileFixture("file2.txt", "File 2")
+	run("add", "file2.txt")
+	output := run("flush", "-m", "Another flush")
+	flushHash := hashFromFlushOutput(output)
+	run("pack")
+
+	packs, _ := filepath.Glob(".shit/objects/pack/*.idx")
+	assertInt(t, len(packs), 2)
+
+	output = run("gc")
+	assert(t, output, "Packed 6 objects (1 deltas)\n")
+	packs, _ = filepath.Glob(".shit/objects/pack/*.idx")
+	assertInt(t, len(packs), 1)
+
+	output = run("log")
+	assertLine(t, output, 0, "Flush "+flushHash)
+}
+
+func TestPrune(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	run("add", "file1.txt")
+	run("flush", "-m", "A flush")
+
+	// Replacing the file in the bowl leaves the old blob unreachable
+	fileFixture("file2.txt", "Hello") // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+	run("add", "file2.txt")
+	fileFixture("file2.txt", "Hello again")
+	run("add", "file2.txt")
+
+	// Objects younger than the expiry are kept
+	output := run("prune", "--dry-run")
+	assert(t, output, "")
+
+	past := time.Now().Add(-15 * 24 * time.Hour)
+	for _, hash := range listLooseObjects() {
+		os.Chtimes(objectPath(hash), past, past)
+	}
+
+	output = run("prune", "--dry-run")
+	assert(t, output, "Would prune be12174911e3aae8c2ed6ef5cb66b32893b3bd21\n")
+	assertInt(t, len(listLooseObjects()), 5)
+
+	output = run("prune")
+	assert(t, output, "Pruned be12174911e3aae8c2ed6ef5cb66b32893b3bd21\n")
+	assertInt(t, len(listLooseObjects()), 4)
+
+	// Objects only referenced from the reflog are kept
+	reflog := readReflog("master")
+	assertInt(t, len(reflog), 1)
+	assert(t, reflog[0].Message, "flush: A flush")
+	os.Remove(".shit/refs/master")
+	output = run("prune", "--expire=now")
+	assert(t, output, "")
+
+	// Unreachable packed objects are dropped by gc
+	fileFixture("file2.txt", "Hello")
+	run("add", "file2.txt")
+	run("pack")
+	fileFixture("file2.txt", "Hello again")
+	run("add", "file2.txt")
+
+	// Unreachable packed objects younger than the expiry are kept as loose objects
+	output = run("gc")
+	assert(t, output, "Packed 4 objects (0 deltas)\n")
+	assertObject(t, "be12174911e3aae8c2ed6ef5cb66b32893b3bd21", "file\n\nHello")
+
+	output = run("gc", "--expire=now")
+	assert(t, output, "Pruned be12174911e3aae8c2ed6ef5cb66b32893b3bd21\nPacked 4 objects (0 deltas)\n")
+}
+
+func TestFsck(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	fileFixture("file2.txt", "Hello")  // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+	run("add", "-A")
+	run("flush", "-m", "A flush")
+	output := run("fsck")
+	assert(t, output, "")
+
+	// Replaced blobs are dangling
+	fileFixture("file3.txt", "Temporary")
+	run("add", "file3.txt")
+	fileFixture("file3.txt", "Hello")
+	run("add", "file3.txt")
+	output = run("fsck")
+	assert(t, output, "dangling file "+hash([]byte("file\n\nTemporary"))+"\n")
+	run("prune", "--expire=now")
+
+	// Corrupt and missing objects are reported
+	writeFile(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3"), compress([]byte("file\n\nA tesT")))
+	os.Remove(objectPath("be12174911e3aae8c2ed6ef5cb66b32893b3bd21"))
+	fileFixture(".shit/objects/00/00000000000000000000000000000000000000", "Not zlib")
+
+	report := fsck()
+	assertInt(t, len(report.Errors), 2)
+	assert(t, report.Errors[0], "0000000000000000000000000000000000000000: unreadable object: unknown compression")
+	assert(t, report.Errors[1], "c4a5964fd224738514ccd7354a45d37a5ef1a8b3: hash mismatch, content hashes to "+hash([]byte("file\n\nA tesT")))
+	assertInt(t, len(report.Missing), 1)
+	assert(t, report.Missing[0][:65], "file be12174911e3aae8c2ed6ef5cb66b32893b3bd21 (referenced by tree")
+
+	os.Remove(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3"))
+	report = fsck()
+	assertInt(t, len(report.Missing), 2)
+}
+
+func TestVerifyObjectOnRead(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	run("add", "file1.txt")
+	output := run("flush", "-m", "A flush")
+	flushHash := hashFromFlushOutput(output)
+
+	writeFile(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3"), compress([]byte("file\n\nA tesT")))
+
+	err := catchPanic(func() { getObject("c4a5964fd224738514ccd7354a45d37a5ef1a8b3") })
+	assert(t, fmt.Sprint(err), "Object c4a5964fd224738514ccd7354a45d37a5ef1a8b3 is corrupt, its content hashes to "+hash([]byte("file\n\nA tesT")))
+
+	// A corrupt object is not written to the workdir
+	fileFixture("file1.txt", "Local")
+	err = catchPanic(func() { writeObjectToFile("c4a5964fd224738514ccd7354a45d37a5ef1a8b3", "file1.txt", 0644) })
+	if _, corrupt := err.(*CorruptObjectError); !corrupt {
+		t.Errorf("Expected a CorruptObjectError, got %v", err)
+	}
+	assertFile(t, "file1.txt", "Local")
+
+	// Verification can be turned off, or limited to small objects
+	run("config", "core.verifyMaxSize", "10")
+	assert(t, getObject("c4a5964fd224738514ccd7354a45d37a5ef1a8b3").Content, "A tesT")
+	run("config", "core.verifyMaxSize", "0")
+	run("config", "core.verifyObjects", "false")
+	assert(t, getObject("c4a5964fd224738514ccd7354a45d37a5ef1a8b3").Content, "A tesT")
+	output = run("config", "core.verifyObjects")
+	assert(t, output, "false\n")
+
+	run("add", "file1.txt")
+	run("plunge", "--force", flushHash)
+	assertFile(t, "file1.txt", "A tesT")
+}
+
+func TestSha256ObjectFormat(t *testing.T) {
+	initt(t)
+	os.RemoveAll(".shit")
+	run("init", "--object-format=sha256")
+
+	output := run("config", "core.objectFormat")
+	assert(t, output, "sha256\n")
+
+	fileFixture("file1.txt", "A test")
+	fileFixture("dir1/file2.txt", "Hello")
+	run("add", "-A")
+	output = run("sniff")
+	assert(t, output, `3ee072fac0243b41cb5e10793fd4bd9928f20df902c9503feee85bcdc27c4b7b dir1/file2.txt
+e257c0ac7d44ff303b1235289115d5c12d1b3867ceebd17e3893309d611820b8 file1.txt
+`)
+
+	output = run("flush", "-m", "A flush")
+	flushHash := hashFromFlushOutput(output)
+	assertInt(t, len(flushHash), 64)
+
+	flush := getFlush(flushHash)
+	assertInt(t, len(flush.TreeHash), 64)
+	tree := getTree(flush.TreeHash)
+	assertInt(t, len(tree.Nodes[0].Hash), 64)
+
+	run("pack")
+	output = run("fsck")
+	assert(t, output, "")
+	assert(t, getObject("e257c0ac7d44ff303b1235289115d5c12d1b3867ceebd17e3893309d611820b8").Content, "A test")
+
+	// SHA-1 object names are rejected
+	err := catchPanic(func() { getObject("c4a5964fd224738514ccd7354a45d37a5ef1a8b3") })
+	assert(t, fmt.Sprint(err), "Invalid object name c4a5964fd224738514ccd7354a45d37a5ef1a8b3, expected a sha256 hash")
+
+	// The object format can't be changed after init
+	assert(t, fmt.Sprint(checkConfigChange("core.objectFormat", "sha1")), "core.objectFormat can only be set by shit init, the existing objects use sha256 hashes.")
+	assert(t, fmt.Sprint(checkConfigChange("core.objectFormat", "sha256")), "<nil>")
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test") // Hash = c4a5964fd224738514ccd7354a45d37a5ef1a8b3
+	run("add", "file1.txt")
+	assert(t, detectCodec([]byte(getFile(objectPath("c4a5964fd224738514ccd7354a45d37a5ef1a8b3")))), "zlib")
+
+	run("config", "core.compression", "zstd")
+	run("config", "core.compressionLevel", "3")
+
+	// Unknown codecs and unsupported levels are rejected before they are saved
+	assert(t, fmt.Sprint(checkConfigChange("core.compression", "zst")), "Unsupported compression zst, expected zlib, zstd or none.")
+	assert(t, fmt.Sprint(checkConfigChange("core.compressionLevel", "23")), "Invalid compression level 23 for zstd: zstd: invalid compression level: 23.")
+	assert(t, fmt.Sprint(checkConfigChange("core.compressionLevel", "high")), `core.compressionLevel must be an integer, was "high".`)
+	assert(t, fmt.Sprint(checkConfigChange("core.compressionLevel", "19")), "<nil>")
+	assert(t, fmt.Sprint(checkConfigChange("core.compression", "zlib")), "<nil>")
+	fileFixture("file2.txt", "Hello") // Hash = be12174911e3aae8c2ed6ef5cb66b32893b3bd21
+	run("add", "file2.txt")
+	assert(t, detectCodec([]byte(getFile(objectPath("be12174911e3aae8c2ed6ef5cb66b32893b3bd21")))), "zstd")
+
+	run("config", "core.compression", "none")
+	fileFixture("file3.txt", "Uncompressed")
+	run("add", "file3.txt")
+	output := run("flush", "-m", "A flush")
+	flushHash := hashFromFlushOutput(output)
+	assert(t, getFile(objectPath(flushHash))[:7], "flush\n\n")
+	assert(t, detectCodec([]byte(getFile(objectPath(flushHash)))), "none")
+	assert(t, detectCodec([]byte("Not an object")), "")
+
+	// Objects written with any codec can be read regardless of the configured codec
+	run("config", "core.compression", "zlib")
+	output = run("sniff")
+	assert(t, output, `c4a5964fd224738514ccd7354a45d37a5ef1a8b3 file1.txt
+be12174911e3aae8c2ed6ef5cb66b32893b3bd21 file2.txt
+`+hash([]byte("file\n\nUncompressed"))+" file3.txt\n")
+	assertObject(t, "be12174911e3aae8c2ed6ef5cb66b32893b3bd21", "file\n\nHello")
+	output = run("fsck")
+	assert(t, output, "")
+
+	run("config", "core.compression", "zstd")
+	run("pack")
+	assert(t, getObject("c4a5964fd224738514ccd7354a45d37a5ef1a8b3").Content, "A test")
+	assert(t, getObject("be12174911e3aae8c2ed6ef5cb66b32893b3bd21").Content, "Hello")
+
+	// Deltas in packs written without compression can be read back
+	run("config", "core.compression", "none")
+	content := strings.Repeat("Line of text\n", 100)
+	fileFixture("file4.txt", content)
+	run("add", "file4.txt")
+	run("flush", "-m", "Add file4")
+	fileFixture("file4.txt", content+"One more line\n")
+	run("add", "file4.txt")
+	run("flush", "-m", "Change file4")
+	output = run("pack")
+	if !strings.Contains(output, "deltas") || strings.Contains(output, "(0 deltas)") {
+		t.Errorf("Expected deltas in the pack, got %s", output)
+	}
+	assert(t, getObject(hash([]byte("file\n\n"+content))).Content, content)
+	assert(t, getObject(hash([]byte("file\n\n"+content+"One more line\n"))).Content, content+"One more line\n")
+	output = run("fsck")
+	assert(t, output, "")
+}
+
+func TestUpdateRef(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test")
+	run("add", "file1.txt")
+	output := run("flush", "-m", "A flush")
+	flushHash := hashFromFlushOutput(output)
+	assertFile(t, ".shit/refs/master", flushHash)
+
+	// The ref is only updated if it still points at the expected hash
+	err := updateRef("master", "", "c4a5964fd224738514ccd7354a45d37a5ef1a8b3", "update")
+	if _, conflict := err.(*RefConflictError); !conflict {
+		t.Errorf("Expected a RefConflictError, got %v", err)
+	}
+	assertFile(t, ".shit/refs/master", flushHash)
+
+	err = updateRef("master", flushHash, "c4a5964fd224738514ccd7354a45d37a5ef1a8b3", "update")
+	if err != nil {
+		t.Error(err)
+	}
+	assertFile(t, ".shit/refs/master", "c4a5964fd224738514ccd7354a45d37a5ef1a8b3")
+	assert(t, readReflog("master")[1].Message, "update")
+
+	// A locked ref can't be updated
+	run("config", "core.lockTimeout", "0")
+	fileFixture(".shit/refs/master.lock", "")
+	err = updateRef("master", "c4a5964fd224738514ccd7354a45d37a5ef1a8b3", flushHash, "update")
+	if err == nil {
+		t.Error("Updated a locked ref")
+	}
+	assertFile(t, ".shit/refs/master", "c4a5964fd224738514ccd7354a45d37a5ef1a8b3")
+	assert(t, strings.Join(listRefs(), ","), "master")
+
+	// No temp files are left behind by atomic writes
+	assertDir(t, ".shit", "HEAD\nbowl\nconfig\nlogs\nobjects\nrefs")
+}
+
+func TestLocking(t *testing.T) {
+	initt(t)
+
+	// Concurrent read-modify-write cycles are serialised
+	fileFixture("counter", "0")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := acquireLock("counter")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			count, _ := strconv.Atoi(getFile("counter"))
+			lock.Commit(bytes.NewBufferString(strconv.Itoa(count + 1)))
+		}()
+	}
+	wg.Wait()
+	assertFile(t, "counter", "8")
+
+	// Locks held by a live process fail cleanly once the timeout passes
+	hostname, _ := os.Hostname()
+	run("config", "core.lockTimeout", "100")
+	fileFixture(".shit/bowl.lock", fmt.Sprintf("%d %s", os.Getpid(), hostname))
+	_, err := acquireLock(".shit/bowl")
+	assert(t, fmt.Sprint(err), fmt.Sprintf("Unable to lock .shit/bowl, it is locked by process %d on %s. If no other shit process is running, remove .shit/bowl.lock and try again.", os.Getpid(), hostname))
+
+	// Stale locks left by dead processes are removed
+	fileFixture(".shit/bowl.lock", fmt.Sprintf("%d %s", math.MaxInt32, hostname))
+	fileFixture("file1.txt", "A test")
+	run("add", "file1.txt")
+	output := run("sniff")
+	assert(t, output, "c4a5964fd224738514ccd7354a45d37a5ef1a8b3 file1.txt\n")
+	if _, err := os.Stat(".shit/bowl.lock"); err == nil {
+		t.Error("Bowl lock was not released")
+	}
+
+	// Old locks are only removed if their owner can't be checked
+	old := time.Now().Add(-2 * STALE_LOCK_AGE)
+	fileFixture(".shit/bowl.lock", fmt.Sprintf("%d %s", os.Getpid(), hostname))
+	os.Chtimes(".shit/bowl.lock", old, old)
+	assert(t, fmt.Sprint(removeStaleLock(".shit/bowl")), "false")
+	fileFixture(".shit/bowl.lock", fmt.Sprintf("%d %s", os.Getpid(), "other-host"))
+	assert(t, fmt.Sprint(removeStaleLock(".shit/bowl")), "false")
+	os.Chtimes(".shit/bowl.lock", old, old)
+	assert(t, fmt.Sprint(removeStaleLock(".shit/bowl")), "true")
+
+	// A lock that was taken over is not removed on release
+	lock, err := acquireLock(".shit/bowl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(".shit/bowl.lock")
+	fileFixture(".shit/bowl.lock", "Another lock")
+	assert(t, fmt.Sprint(lock.owned()), "false")
+	lock.Release()
+	assertFile(t, ".shit/bowl.lock", "Another lock")
+	os.Remove(".shit/bowl.lock")
+}
+
+func TestDelta(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 64))
+	target := append([]byte("prefix"), base[100:900]...)
+	target = append(target, []byte("suffix")...)
+
+	delta := createDelta(base, target)
+	if len(delta) > 50 {
+		t.Errorf("Delta was %d bytes", len(delta))
+	}
+	assert(t, string(applyDelta(base, delta)), string(target))
+
+	// A delta against an unrelated base is all inserts
+	assert(t, string(applyDelta([]byte("abc"), createDelta([]byte("abc"), target))), string(target))
+
+	// Repetitive data has a bounded number of match candidates per block, so
+	// that it is delta compressed in linear time
+	base = []byte(strings.Repeat("0123456789abcdef", 1<<14))
+	blocks := indexDeltaBlocks(base)
+	assertInt(t, len(blocks), 1)
+	assertInt(t, len(blocks["0123456789abcdef"]), DELTA_MAX_CANDIDATES)
+	target = append([]byte(string(base[:1<<17])), 'x')
+	target = append(target, base[1<<17:]...)
+	assert(t, string(applyDelta(base, createDelta(base, target))), string(target))
+}
+
+func TestPlungeConflicts(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	fileFixture("file2.txt", "Unchanged")
+	run("add", "-A")
+	output := run("flush", "-m", "First flush")
+	firstHash := hashFromFlushOutput(output)
+	fileFixture("file1.txt", "Line 1\nLine 2 changed\nLine 3\nLine 4\nLine 5\n")
+	fileFixture("file3.txt", "New file")
+	run("add", "-A")
+	output = run("flush", "-m", "Second flush")
+	secondHash := hashFromFlushOutput(output)
+
+	conflicts := func(hash string) string {
+		bowl := getBowl()
+		changes := plungeChanges(bowl, getObject(getFlush(hash).TreeHash).ToTree().ToBowl())
+		modified, untracked := plungeConflicts(bowl, changes, getBowlMtime())
+		return fmt.Sprint(modified, untracked)
+	}
+
+	// Local changes to files that plunging does not change are not conflicts
+	fileFixture("file1.txt", "Line 1\nLine 2 changed\nLine 3\nLine 4 local\nLine 5\n")
+	fileFixture("file2.txt", "Local change")
+	assert(t, conflicts(firstHash), "[file1.txt] []")
+
+	output = run("plunge", "--merge", firstHash)
+	assert(t, output, "Head is "+firstHash+"\nMerged file1.txt\nPlunged out "+firstHash+"\n")
+	assertFile(t, "file1.txt", "Line 1\nLine 2\nLine 3\nLine 4 local\nLine 5\n")
+	assertFile(t, "file2.txt", "Local change")
+	if _, err := os.Stat("file3.txt"); err == nil {
+		t.Error("file3.txt was not deleted")
+	}
+
+	// Untracked files are never merged
+	fileFixture("file1.txt", "Line 1\nLine 2 local\nLine 3\nLine 4 local\nLine 5\n")
+	fileFixture("file3.txt", "Untracked")
+	assert(t, conflicts(secondHash), "[file1.txt] [file3.txt]")
+	os.Remove("file3.txt")
+
+	output = run("plunge", "--merge", secondHash)
+	assert(t, output, "Head is "+secondHash+"\nCONFLICT (content): Merge conflict in file1.txt\nPlunged out "+secondHash+"\n")
+	assertFile(t, "file1.txt", "Line 1\n<<<<<<< local\nLine 2 local\n=======\nLine 2 changed\n>>>>>>> "+secondHash+"\nLine 3\nLine 4 local\nLine 5\n")
+	assertFile(t, "file3.txt", "New file")
+
+	run("plunge", "--force", firstHash)
+	assertFile(t, "file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	assertFile(t, "file2.txt", "Local change")
+
+	// Staged changes that were never flushed are conflicts as well, while the
+	// bowl of the plunged flush is not
+	bowl := getBowl()
+	changes := plungeChanges(bowl, getObject(getFlush(secondHash).TreeHash).ToTree().ToBowl())
+	assert(t, fmt.Sprint(stagedConflicts(bowl, plungeBase(), changes)), "[]")
+	fileFixture("file1.txt", "Staged change")
+	run("add", "file1.txt")
+	bowl = getBowl()
+	changes = plungeChanges(bowl, getObject(getFlush(secondHash).TreeHash).ToTree().ToBowl())
+	assert(t, fmt.Sprint(stagedConflicts(bowl, plungeBase(), changes)), "[file1.txt]")
+}
+
+func TestPlungeIncremental(t *testing.T) {
+	initt(t)
+
+	fileFixture("a.txt", "A")
+	fileFixture("dir/b.txt", "B")
+	fileFixture("run.sh", "echo hello")
+	os.Chmod("run.sh", 0755)
+	run("add", "-A")
+	output := run("flush", "-m", "First flush")
+	firstHash := hashFromFlushOutput(output)
+	tree := getObject(getFlush(firstHash).TreeHash)
+	if !strings.Contains(tree.Content, "exec 3316a26be3dba0a7c3e044be2ee95c8f997ce467 run.sh") {
+		t.Errorf("Executable was not stored as an exec node:\n%s", tree.Content)
+	}
+
+	fileFixture("dir/b.txt", "B changed")
+	fileFixture("new/dir/c.txt", "C")
+	os.Chmod("run.sh", 0644)
+	run("add", "-A")
+	output = run("flush", "-m", "Second flush")
+	secondHash := hashFromFlushOutput(output)
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes("a.txt", past, past)
+	os.Chtimes("run.sh", past, past)
+
+	run("plunge", firstHash)
+	assertFile(t, "dir/b.txt", "B")
+	if _, err := os.Stat("new"); err == nil {
+		t.Error("Empty directories of deleted files were not removed")
+	}
+
+	// Untouched files keep their mtime, and mode changes don't rewrite files
+	for _, path := range []string{"a.txt", "run.sh"} {
+		info, _ := os.Stat(path)
+		if !info.ModTime().Equal(past) {
+			t.Errorf("%s was rewritten", path)
+		}
+	}
+	info, _ := os.Stat("run.sh")
+	assert(t, info.Mode().String(), "-rwxr-xr-x")
+
+	// The bowl matches the workdir after plunging
+	output = run("sniff")
+	run("add", "-A")
+	assert(t, run("sniff"), output)
+	assert(t, run("create-tree"), "Created tree "+tree.Hash+"\n")
+
+	// An untracked file in the way of a directory is a conflict
+	fileFixture("new", "Untracked")
+	bowl := getBowl()
+	modified, untracked := plungeConflicts(bowl, plungeChanges(bowl, getObject(getFlush(secondHash).TreeHash).ToTree().ToBowl()), getBowlMtime())
+	assert(t, fmt.Sprint(modified, untracked), "[] [new]")
+	run("plunge", "--force", secondHash)
+	assertFile(t, "new/dir/c.txt", "C")
+
+	// So is an untracked directory in the way of a file
+	run("plunge", "--force", firstHash)
+	fileFixture("new/dir/c.txt/untracked.txt", "Untracked")
+	bowl = getBowl()
+	modified, untracked = plungeConflicts(bowl, plungeChanges(bowl, getObject(getFlush(secondHash).TreeHash).ToTree().ToBowl()), getBowlMtime())
+	assert(t, fmt.Sprint(modified, untracked), "[] [new/dir/c.txt]")
+	run("plunge", "--force", secondHash)
+	assertFile(t, "new/dir/c.txt", "C")
+	output = run("sniff")
+	run("add", "-A")
+	assert(t, run("sniff"), output)
+}
+
+func TestStash(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\n")
+	fileFixture("file2.txt", "File 2")
+	run("add", "-A")
+	output := run("flush", "-m", "First flush")
+	firstHash := hashFromFlushOutput(output)
+	headSniff := run("sniff")
+
+	output = run("stash")
+	assert(t, output, "No local changes to save\n")
+
+	// Stash a staged change, an unstaged change and a new file
+	fileFixture("file1.txt", "Line 1 stashed\nLine 2\nLine 3\n")
+	fileFixture("file3.txt", "File 3")
+	run("add", "-A")
+	fileFixture("file2.txt", "File 2 local")
+
+	output = run("stash")
+	assert(t, output, "Saved working directory and bowl state WIP on master: "+firstHash[:7]+" First flush\n")
+	assertFile(t, "file1.txt", "Line 1\nLine 2\nLine 3\n")
+	assertFile(t, "file2.txt", "File 2")
+	if _, err := os.Stat("file3.txt"); err == nil {
+		t.Error("file3.txt was not removed")
+	}
+	assert(t, run("sniff"), headSniff)
+	assert(t, run("stash", "list"), "stash@{0}: WIP on master: "+firstHash[:7]+" First flush\n")
+	assert(t, run("stash", "show"), "M file1.txt\nM file2.txt\nA file3.txt\n")
+
+	// Changes flushed since stashing are merged with the stashed changes
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3 upstream\n")
+	run("add", "file1.txt")
+	run("flush", "-m", "Second flush")
+	stashHash := readRef(STASH_REF)
+
+	output = run("stash", "pop")
+	assert(t, output, "Merged file1.txt\nDropped stash@{0} ("+stashHash+")\n")
+	assertFile(t, "file1.txt", "Line 1 stashed\nLine 2\nLine 3 upstream\n")
+	assertFile(t, "file2.txt", "File 2 local")
+	assertFile(t, "file3.txt", "File 3")
+	assert(t, run("stash", "list"), "")
+
+	// The staged new file is restored to the bowl, unstaged changes are not
+	output = run("sniff")
+	assert(t, output, "9c63550aa6c938f94b48f9b42e1ba6fe30339b24 file1.txt\n"+strings.Split(headSniff, "\n")[1]+"\n1ac32dab6eb4edc1d01c114e701b67ab3d978f2f file3.txt\n")
+
+	run("stash", "push", "-m", "Some work")
+	fileFixture("file2.txt", "More work")
+	run("stash", "push", "-m", "More work")
+	assert(t, run("stash", "list"), "stash@{0}: On master: More work\nstash@{1}: On master: Some work\n")
+	run("stash", "drop", "stash@{1}")
+	assert(t, run("stash", "list"), "stash@{0}: On master: More work\n")
+
+	run("stash", "apply")
+	assertFile(t, "file2.txt", "More work")
+	assert(t, run("stash", "list"), "stash@{0}: On master: More work\n")
+	run("stash", "drop")
+	if _, err := os.Stat(filepath.Join(REFS_PATH, STASH_REF)); err == nil {
+		t.Error("Stash ref was not removed after dropping the last entry")
+	}
+}
+
+func TestCherryPick(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output := run("flush", "-m", "Base")
+	baseHash := hashFromFlushOutput(output)
+
+	// Flush some changes on a feature branch
+	updateRef("feature", "", baseHash, "branch: Created from master")
+	writeFile(HEAD_PATH, bytes.NewBufferString("feature"))
+	fileFixture("file1.txt", "Line 1\nLine 2 feature\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	run("flush", "-m", "Feature change")
+	fileFixture("file2.txt", "Feature file")
+	run("add", "-A")
+	output = run("flush", "-m", "Add feature file")
+	addFileHash := hashFromFlushOutput(output)
+	fileFixture("file1.txt", "Line 1\nLine 2 feature 2\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Another feature change")
+	conflictHash := hashFromFlushOutput(output)
+
+	writeFile(HEAD_PATH, bytes.NewBufferString("master"))
+	run("plunge", "--force", baseHash)
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5 master\n")
+	run("add", "-A")
+	run("flush", "-m", "Master change")
+
+	output = run("cherry-pick", "feature~2")
+	assert(t, strings.Split(output, "\n")[0], "Merged file1.txt")
+	assertFile(t, "file1.txt", "Line 1\nLine 2 feature\nLine 3\nLine 4\nLine 5 master\n")
+	assert(t, getHead().Message, "Feature change\n")
+
+	run("cherry-pick", addFileHash[:7])
+	assertFile(t, "file2.txt", "Feature file")
+	assert(t, getHead().Message, "Add feature file\n")
+
+	output = run("cherry-pick", "feature~2")
+	assert(t, output, "Merged file1.txt\nNothing to flush for \"Feature change\", its changes are already applied\n")
+
+	// Conflicts stop the cherry-pick until they are resolved
+	fileFixture("file1.txt", "Line 1\nLine 2 master\nLine 3\nLine 4\nLine 5 master\n")
+	run("add", "-A")
+	run("flush", "-m", "Conflicting master change")
+	pickedHash := getHead().Object.Hash
+	startConflict := func() {
+		os.MkdirAll(SEQUENCER_PATH, 0775)
+		writeFile(filepath.Join(SEQUENCER_PATH, "command"), bytes.NewBufferString("cherry-pick"))
+		writeFile(filepath.Join(SEQUENCER_PATH, "head"), bytes.NewBufferString(getHead().Object.Hash))
+		writeSequencerTodo([]SequencerStep{{Action: "pick", Hash: conflictHash}})
+		if applySequencerStep(SequencerStep{Action: "pick", Hash: conflictHash}) {
+			t.Fatal("Expected a conflict")
+		}
+	}
+	startConflict()
+	assertFile(t, "file1.txt", "Line 1\n<<<<<<< HEAD\nLine 2 master\n=======\nLine 2 feature 2\n>>>>>>> "+conflictHash[:7]+" (Another feature change)\nLine 3\nLine 4\nLine 5 master\n")
+	assert(t, fmt.Sprint(unresolvedConflicts(getBowl(), []string{"file1.txt"})), "[file1.txt]")
+
+	fileFixture("file1.txt", "Line 1\nLine 2 resolved\nLine 3\nLine 4\nLine 5 master\n")
+	run("add", "file1.txt")
+	run("cherry-pick", "--continue")
+	assert(t, getHead().Message, "Another feature change\n")
+	assert(t, getHead().ParentHash, pickedHash)
+	if _, err := os.Stat(SEQUENCER_PATH); err == nil {
+		t.Error("Sequencer state was not removed")
+	}
+
+	// Local changes to the picked paths are refused before any state is
+	// written, and abort keeps local changes to other files
+	resolvedHash := getHead().Object.Hash
+	fileFixture("file1.txt", "Line 1\nLine 2 local\nLine 3\nLine 4\nLine 5 master\n")
+	modified, _ := sequencerConflicts([]SequencerStep{{Action: "pick", Hash: conflictHash}})
+	assert(t, fmt.Sprint(modified), "[file1.txt]")
+	fileFixture("file1.txt", "Line 1\nLine 2 resolved\nLine 3\nLine 4\nLine 5 master\n")
+	fileFixture("file2.txt", "Local change")
+	startConflict()
+	output = run("cherry-pick", "--abort")
+	assert(t, output, "Aborted cherry-pick, HEAD is back at "+resolvedHash+"\n")
+	assertFile(t, "file1.txt", "Line 1\nLine 2 resolved\nLine 3\nLine 4\nLine 5 master\n")
+	assertFile(t, "file2.txt", "Local change")
+	if _, err := os.Stat(SEQUENCER_PATH); err == nil {
+		t.Error("Sequencer state was not removed")
+	}
+}
+
+func TestRevert(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	run("flush", "-m", "Base")
+	fileFixture("file1.txt", "Line 1\nLine 2 bad\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output := run("flush", "-m", "Bad change\n\nWith a description")
+	badHash := hashFromFlushOutput(output)
+	fileFixture("file1.txt", "Line 1\nLine 2 bad\nLine 3\nLine 4\nLine 5 later\n")
+	fileFixture("file2.txt", "File 2")
+	run("add", "-A")
+	run("flush", "-m", "Later change")
+
+	output = run("revert", "HEAD~1")
+	assert(t, strings.Split(output, "\n")[0], "Merged file1.txt")
+	assertFile(t, "file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5 later\n")
+	assert(t, getHead().Message, "Revert \"Bad change\"\n\nThis reverts flush "+badHash+".\n")
+
+	// Reverting a flush that added a file deletes it
+	run("revert", "HEAD~1")
+	assertFile(t, "file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	if _, err := os.Stat("file2.txt"); err == nil {
+		t.Error("file2.txt was not deleted")
+	}
+
+	// Reverting changes that were changed again conflicts
+	fileFixture("file1.txt", "Line 1\nLine 2 again\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Change again")
+	headHash := hashFromFlushOutput(output)
+	os.MkdirAll(SEQUENCER_PATH, 0775)
+	writeFile(filepath.Join(SEQUENCER_PATH, "command"), bytes.NewBufferString("revert"))
+	writeFile(filepath.Join(SEQUENCER_PATH, "head"), bytes.NewBufferString(headHash))
+	writeSequencerTodo([]SequencerStep{{Action: "revert", Hash: badHash}})
+	if applySequencerStep(SequencerStep{Action: "revert", Hash: badHash}) {
+		t.Fatal("Expected a conflict")
+	}
+	assertFile(t, "file1.txt", "Line 1\n<<<<<<< HEAD\nLine 2 again\n=======\nLine 2\n>>>>>>> parent of "+badHash[:7]+" (Bad change)\nLine 3\nLine 4\nLine 5\n")
+
+	output = run("revert", "--abort")
+	assert(t, output, "Aborted revert, HEAD is back at "+headHash+"\n")
+	assertFile(t, "file1.txt", "Line 1\nLine 2 again\nLine 3\nLine 4\nLine 5\n")
+}
+
+func TestRebase(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output := run("flush", "-m", "Base")
+	baseHash := hashFromFlushOutput(output)
+
+	updateRef("feature", "", baseHash, "branch: Created from master")
+	writeFile(HEAD_PATH, bytes.NewBufferString("feature"))
+	fileFixture("file1.txt", "Line 1\nLine 2 feature\nLine 3\nLine 4\nLine 5\n")
+	run("add", "-A")
+	run("flush", "-m", "Feature change")
+	fileFixture("file2.txt", "Feature file")
+	run("add", "-A")
+	run("flush", "-m", "Add feature file")
+	fileFixture("file1.txt", "Line 1\nLine 2 feature\nLine 3 feature\nLine 4\nLine 5\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Another feature change")
+	featureHash := hashFromFlushOutput(output)
+
+	writeFile(HEAD_PATH, bytes.NewBufferString("master"))
+	run("plunge", "--force", baseHash)
+	fileFixture("file1.txt", "Line 1\nLine 2\nLine 3\nLine 4\nLine 5 master\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Master change")
+	masterHash := hashFromFlushOutput(output)
+
+	writeFile(HEAD_PATH, bytes.NewBufferString("feature"))
+	run("plunge", "--force", featureHash)
+	output = run("rebase", "master")
+	lines := strings.Split(output, "\n")
+	assert(t, lines[len(lines)-2], "Successfully rebased and updated feature")
+	assertFile(t, "file1.txt", "Line 1\nLine 2 feature\nLine 3 feature\nLine 4\nLine 5 master\n")
+	assertFile(t, "file2.txt", "Feature file")
+	head := getHead()
+	assert(t, head.Message, "Another feature change\n")
+	assert(t, getFlush(getFlush(head.ParentHash).ParentHash).ParentHash, masterHash)
+	assert(t, readRef("master"), masterHash)
+	assert(t, findMergeBase(featureHash, masterHash), baseHash)
+
+	output = run("rebase", "master")
+	assert(t, output, "Current branch feature is up to date.\n")
+
+	// Drop the second flush and squash the third into the first
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	writeFile(editor, bytes.NewBufferString(`case "$1" in
+*REBASE_TODO) sed -i -e '2s/^pick/drop/' -e '3s/^pick/s/' "$1" ;;
+*) sed -i '1s/.*/Squashed/' "$1" ;;
+esac
+`))
+	t.Setenv("SHIT_EDITOR", "sh "+editor)
+	run("rebase", "-i", "HEAD~3")
+	head = getHead()
+	assert(t, head.Message, "Squashed\n\nAnother feature change\n")
+	assert(t, head.ParentHash, masterHash)
+	assertFile(t, "file1.txt", "Line 1\nLine 2 feature\nLine 3 feature\nLine 4\nLine 5 master\n")
+	if _, err := os.Stat("file2.txt"); err == nil {
+		t.Error("file2.txt of the dropped flush was not removed")
+	}
+	if _, err := os.Stat(SEQUENCER_PATH); err == nil {
+		t.Error("Sequencer state was not removed")
+	}
+
+	// A conflicting flush can be skipped
+	run("plunge", masterHash)
+	writeFile(HEAD_PATH, bytes.NewBufferString("master"))
+	fileFixture("file1.txt", "Line 1\nLine 2 master\nLine 3\nLine 4\nLine 5 master\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Conflicting master change")
+	conflictHash := hashFromFlushOutput(output)
+	os.MkdirAll(SEQUENCER_PATH, 0775)
+	writeFile(filepath.Join(SEQUENCER_PATH, "command"), bytes.NewBufferString("rebase"))
+	writeFile(filepath.Join(SEQUENCER_PATH, "head"), bytes.NewBufferString(conflictHash))
+	writeSequencerTodo([]SequencerStep{{Action: "pick", Hash: head.Object.Hash}})
+	if applySequencerStep(SequencerStep{Action: "pick", Hash: head.Object.Hash}) {
+		t.Fatal("Expected a conflict")
+	}
+	output = run("rebase", "--skip")
+	assert(t, output, "Successfully rebased and updated master\n")
+	assert(t, getHead().Object.Hash, conflictHash)
+	assertFile(t, "file1.txt", "Line 1\nLine 2 master\nLine 3\nLine 4\nLine 5 master\n")
+}
+
+func TestBlame(t *testing.T) {
+	initt(t)
+
+	run("config", "user.name", "Alice")
+	run("config", "user.email", "alice@example.com")
+	fileFixture("dir/sub/file.txt", "Line 1\nLine 2\nLine 3\n")
+	run("add", "-A")
+	output := run("flush", "-m", "Add file")
+	hash1 := hashFromFlushOutput(output)
+
+	run("config", "user.name", "Bob")
+	run("config", "user.email", "bob@example.com")
+	fileFixture("dir/sub/file.txt", "Line 1\nLine 2 changed\nLine 3\nLine 4\n")
+	run("add", "-A")
+	output = run("flush", "-m", "Change file")
+	hash2 := hashFromFlushOutput(output)
+	fileFixture("other.txt", "Other")
+	run("add", "-A")
+	run("flush", "-m", "Add other file")
+
+	assert(t, getFlush(hash1).Author, "Alice <alice@example.com>")
+	date1 := getFlush(hash1).Date
+	date2 := getFlush(hash2).Date
+	output = run("blame", "dir/sub/file.txt")
+	assert(t, output, hash1[:7]+" (Alice <alice@example.com> "+date1+" 1) Line 1\n"+
+		hash2[:7]+" (Bob <bob@example.com>     "+date2+" 2) Line 2 changed\n"+
+		hash1[:7]+" (Alice <alice@example.com> "+date1+" 3) Line 3\n"+
+		hash2[:7]+" (Bob <bob@example.com>     "+date2+" 4) Line 4\n")
+	output = run("blame", "-L", "2,3", "dir/sub/file.txt")
+	assert(t, output, hash2[:7]+" (Bob <bob@example.com>     "+date2+" 2) Line 2 changed\n"+
+		hash1[:7]+" (Alice <alice@example.com> "+date1+" 3) Line 3\n")
+
+	tree := getObject(getHead().TreeHash).ToTree()
+	assert(t, findNode(tree, "dir/sub/file.txt").Content, "Line 1\nLine 2 changed\nLine 3\nLine 4\n")
+	assert(t, fmt.Sprint(findNode(tree, "dir/sub") == nil), "true")
+	assert(t, fmt.Sprint(findNode(tree, "dir/file.txt") == nil), "true")
+
+	// Amended and picked flushes keep their author, reverts get the current one
+	run("config", "user.name", "Carol")
+	run("config", "user.email", "carol@example.com")
+	output = run("flush", "--amend", "-m", "Add another file")
+	assert(t, getFlush(hashFromFlushOutput(output)).Author, "Bob <bob@example.com>")
+	run("revert", hash2)
+	assert(t, getHead().Author, "Carol <carol@example.com>")
+	run("cherry-pick", hash2)
+	assert(t, getHead().Author, "Bob <bob@example.com>")
+	assert(t, fmt.Sprint(fsck().Errors), "[]")
+}
+
+func TestResolveRev(t *testing.T) {
+	initt(t)
+
+	fileFixture("file1.txt", "A test")
+	run("add", "-A")
+	output := run("flush", "-m", "First flush")
+	firstHash := hashFromFlushOutput(output)
+	fileFixture("file1.txt", "Another test")
+	run("add", "-A")
+	output = run("flush", "-m", "Second flush")
+	secondHash := hashFromFlushOutput(output)
+
+	for rev, expected := range map[string]string{
+		"HEAD":               secondHash,
+		"HEAD~":              firstHash,
+		"HEAD~1":             firstHash,
+		"master~0":           secondHash,
+		firstHash:            firstHash,
+		secondHash[:7]:       secondHash,
+		secondHash[:7] + "~": firstHash,
+	} {
+		hash, err := tryResolveRev(rev)
+		if err != nil || hash != expected {
+			t.Errorf("Expected %s to resolve to %s, got %s (%v)", rev, expected, hash, err)
+		}
+	}
+
+	_, err := tryResolveRev("HEAD~2")
+	assert(t, fmt.Sprint(err), "Revision HEAD~2 does not exist, HEAD has only 1 ancestors")
+	_, err = tryResolveRev("unknown")
+	assert(t, fmt.Sprint(err), "Unknown revision unknown")
+	tree := getFlush(firstHash).TreeHash
+	_, err = tryResolveRev(tree)
+	assert(t, fmt.Sprint(err), "Revision "+tree+" is a tree, not a flush")
+}
+
+func TestMerge3(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+
+	merged, conflicts := merge3(base, "a\nB\nc\nd\ne\n", "a\nb\nc\nd\nE\nf\n", "ours", "theirs")
+	assert(t, merged, "a\nB\nc\nd\nE\nf\n")
+	assert(t, fmt.Sprint(conflicts), "false")
+
+	merged, conflicts = merge3(base, "a\nb\nX\nd\ne\n", "a\nb\nY\nd\ne\n", "ours", "theirs")
+	assert(t, merged, "a\nb\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nd\ne\n")
+	assert(t, fmt.Sprint(conflicts), "true")
+
+	// The same change on both sides is not a conflict
+	merged, conflicts = merge3(base, "a\nc\nd\ne\n", "a\nc\nd\ne\n", "ours", "theirs")
+	assert(t, merged, "a\nc\nd\ne\n")
+	assert(t, fmt.Sprint(conflicts), "false")
+}
+
+// Returns the value the function panicked with, or nil
+func catchPanic(f func()) (recovered any) {
+	defer func() {
+		recovered = recover()
+	}()
+	f()
+	return nil
+}
+
+// Creating objects that already exist should not rewrite them
+func BenchmarkCreateObject(b *testing.B) {
+	initt(b)
+	content := strings.Repeat("A line in a file\n", 10000)
+
+	b.Run("new", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			createObject("file", fmt.Sprintf("%d %s", i, content))
+		}
+	})
+	b.Run("existing", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			createObject("file", content)
+		}
+	})
+	b.Run("existing uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resetKnownObjects()
+			createObject("file", content)
+		}
+	})
+}
+
+// Creating a tree from an unchanged bowl should not rewrite any objects
+func BenchmarkCreateTree(b *testing.B) {
+	initt(b)
+	for i := 0; i < 1000; i++ {
+		fileFixture(fmt.Sprintf("dir%d/file%d.txt", i%10, i), fmt.Sprintf("File %d", i))
+	}
+	run("add", "-A")
+	bowl := getBowl()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		createTree(bowl)
+	}
+}
+
+// Sniffing reads only the bowl index and not the staged objects, so its cost
+// should grow with the number of bowl entries and not with the size of the
+// files. The entry counts are kept small enough for run to capture the output.
+func BenchmarkSniff(b *testing.B) {
+	for _, bench := range []struct{ entries, size int }{
+		{10, 1 << 10},
+		{100, 1 << 10},
+		{1000, 1 << 10},
+		{100, 1 << 20},
+	} {
+		b.Run(fmt.Sprintf("%dx%dB", bench.entries, bench.size), func(b *testing.B) {
+			initt(b)
+			content := strings.Repeat("A", bench.size)
+			for i := 0; i < bench.entries; i++ {
+				fileFixture(fmt.Sprintf("file%d.txt", i), fmt.Sprintf("%d %s", i, content))
+			}
+			run("add", "-A")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				run("sniff")
+			}
+		})
+	}
+}
+
 func hashFromFlushOutput(output string) string {
 	cmtHash := strings.Split(strings.Split(output, "\n")[0], " ")[2]
 	return cmtHash
@@ -254,7 +1531,7 @@ func assertDir(t *testing.T, path string, expected string) {
 }
 
 func assertObject(t *testing.T, hash string, expected string) {
-	var reader, err = os.Open(".shit/objects/" + hash)
+	var reader, err = os.Open(objectPath(hash))
 	if err != nil {
 		panic(err)
 	}
@@ -275,7 +1552,7 @@ func assertInt(t *testing.T, actual int, expected int) {
 	}
 }
 
-func initt(t *testing.T) {
+func initt(t testing.TB) {
 	dir := fmt.Sprintf("/tmp/%s_%s", hash([]byte(t.Name())), t.Name())
 	os.RemoveAll(dir)
 	err := os.MkdirAll(dir, 0755)
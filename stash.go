@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Ref of the newest stash entry. All entries are kept in its reflog, newest
+// last, and are addressed as stash@{<n>} with 0 being the newest.
+const STASH_REF = "stash"
+
+// A stash entry is a flush of the workdir state, whose parent is a flush of
+// the bowl state, whose parent is the HEAD flush the changes were made on.
+type StashEntry struct {
+	Base Flush
+	Bowl Flush
+	Wd   Flush
+}
+
+func cmdStash(args []string) {
+	if len(args) == 0 {
+		stashPush(args)
+		return
+	}
+	switch args[0] {
+	case "push":
+		stashPush(args[1:])
+	case "apply":
+		stashApply(parseStashIndex(args[1:]), false)
+	case "pop":
+		stashApply(parseStashIndex(args[1:]), true)
+	case "drop":
+		stashDrop(parseStashIndex(args[1:]))
+	case "list":
+		stashList()
+	case "show":
+		stashShow(parseStashIndex(args[1:]))
+	default:
+		exitUsage()
+	}
+}
+
+func parseStashIndex(args []string) int {
+	if len(args) == 0 {
+		return 0
+	}
+	if len(args) > 1 {
+		exitUsage()
+	}
+	indexStr, found := strings.CutPrefix(args[0], "stash@{")
+	indexStr, closed := strings.CutSuffix(indexStr, "}")
+	index, err := strconv.Atoi(indexStr)
+	if !found || !closed || err != nil || index < 0 {
+		fmt.Printf("Invalid stash entry %s, expected stash@{<n>}.\n", args[0])
+		exitUsage()
+	}
+	return index
+}
+
+// Saves the bowl and the tracked workdir files, and resets both to HEAD
+func stashPush(args []string) {
+	message := ""
+	if len(args) == 2 && args[0] == "-m" {
+		message = args[1]
+	} else if len(args) != 0 {
+		exitUsage()
+	}
+
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+	head := getHead()
+	if head == nil {
+		bowlLock.Release()
+		fmt.Println("Nothing to stash, there are no flushes yet.")
+		os.Exit(1)
+	}
+	bowl := getBowl()
+	wdBowl := workdirBowl(bowl, getBowlMtime())
+	bowlTree := createTree(bowl)
+	wdTree := createTree(wdBowl)
+	if bowlTree.Object.Hash == head.TreeHash && wdTree.Object.Hash == head.TreeHash {
+		fmt.Println("No local changes to save")
+		return
+	}
+
+	branch := getHeadRef()
+	summary, _, _ := strings.Cut(head.Message, "\n")
+	if message == "" {
+		message = fmt.Sprintf("WIP on %s: %s %s", branch, head.Object.Hash[:7], summary)
+	} else {
+		message = fmt.Sprintf("On %s: %s", branch, message)
+	}
+	bowlFlush := createFlushObject(bowlTree.Object.Hash, head.Object.Hash, flushAuthor(), fmt.Sprintf("bowl on %s: %s %s", branch, head.Object.Hash[:7], summary))
+	wdFlush := createFlushObject(wdTree.Object.Hash, bowlFlush.Hash, flushAuthor(), message)
+
+	oldHash := ""
+	if _, err := os.Stat(filepath.Join(REFS_PATH, STASH_REF)); err == nil {
+		oldHash = readRef(STASH_REF)
+	}
+	err := updateRef(STASH_REF, oldHash, wdFlush.Hash, message)
+	if err != nil {
+		panic(err)
+	}
+
+	headBowl := getObject(head.TreeHash).ToTree().ToBowl()
+	writeBowl(bowlLock, resetWorkdir(wdBowl, headBowl))
+	os.Remove(PLUNGED_PATH)
+	fmt.Println("Saved working directory and bowl state " + message)
+}
+
+// Returns the bowl entries of the tracked workdir files as they are now,
+// creating objects for files with local changes. Deleted files are left out.
+func workdirBowl(bowl []BowlEntry, bowlMtime int64) []BowlEntry {
+	entries := []BowlEntry{}
+	changed := []BowlEntry{}
+	for _, entry := range bowl {
+		if _, err := os.Lstat(entry.Path); err != nil {
+			continue
+		}
+		stat := statFile(entry.Path)
+		if statUnchanged(entry.Stat, stat, bowlMtime) {
+			entries = append(entries, entry)
+		} else {
+			changed = append(changed, BowlEntry{Path: entry.Path, Stat: stat})
+		}
+	}
+	createFileObjects(changed)
+	return append(entries, changed...)
+}
+
+// Restores the bowl and workdir changes of a stash entry on top of the
+// current bowl. Paths that were changed both in the stash and since it was
+// made are merged, pop keeps the stash entry if there are conflicts.
+func stashApply(index int, pop bool) {
+	stash := getStashEntry(index)
+	bowlLock := lockBowl()
+	defer bowlLock.Release()
+
+	base := bowlMap(getObject(stash.Base.TreeHash).ToTree().ToBowl())
+	stashBowl := bowlMap(getObject(stash.Bowl.TreeHash).ToTree().ToBowl())
+	stashWd := bowlMap(getObject(stash.Wd.TreeHash).ToTree().ToBowl())
+	currentBowl := getBowl()
+	current := bowlMap(currentBowl)
+
+	paths := []string{}
+	for _, entries := range []map[string]BowlEntry{base, stashBowl, stashWd} {
+		for path := range entries {
+			if !sameEntry(base, stashBowl, path) || !sameEntry(base, stashWd, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	changes := []PlungeChange{}
+	for _, path := range paths {
+		changes = append(changes, PlungeChange{Path: path, OldHash: current[path].Hash, NewHash: stashWd[path].Hash})
+	}
+	modified, untracked := plungeConflicts(currentBowl, changes, getBowlMtime())
+	if len(modified) > 0 || len(untracked) > 0 {
+		bowlLock.Release()
+		if len(modified) > 0 {
+			fmt.Println("Your local changes to the following files would be overwritten by stash:")
+			printPaths(modified)
+		}
+		if len(untracked) > 0 {
+			fmt.Println("The following untracked files would be overwritten by stash:")
+			printPaths(untracked)
+		}
+		fmt.Println("Flush, stash or remove them first.")
+		os.Exit(1)
+	}
+
+	conflicts := false
+	for _, path := range paths {
+		wdEntry, inWd := stashWd[path]
+		if sameEntry(current, base, path) {
+			// Unchanged since the stash was made, restore the stashed state
+			if inWd {
+				err := os.MkdirAll(filepath.Dir(path), 0755)
+				if err != nil {
+					panic(err)
+				}
+				writeObjectToFile(wdEntry.Hash, path, wdEntry.Mode())
+			} else {
+				deleteWdFiles([]BowlEntry{{Path: path}})
+			}
+			bowlEntry, inBowl := stashBowl[path]
+			if !inBowl {
+				delete(current, path)
+			} else if sameEntry(stashBowl, stashWd, path) {
+				current[path] = BowlEntry{Hash: bowlEntry.Hash, Path: path, Stat: statFile(path)}
+			} else {
+				current[path] = BowlEntry{Hash: bowlEntry.Hash, Path: path, Stat: FileStat{Mode: bowlEntry.Stat.Mode}}
+			}
+			continue
+		}
+		if sameEntry(current, stashWd, path) {
+			continue
+		}
+
+		currentEntry, inCurrent := current[path]
+		if !inCurrent || !inWd {
+			conflicts = true
+			fmt.Println("CONFLICT (modify/delete): " + quotePath(path) + " was deleted on one side, keeping the current version")
+			continue
+		}
+		baseContent := ""
+		if baseEntry, inBase := base[path]; inBase {
+			baseContent = getObject(baseEntry.Hash).Content
+		}
+		merged, mergeConflicts := merge3(baseContent, getObject(currentEntry.Hash).Content, getObject(wdEntry.Hash).Content, "Updated upstream", "Stashed changes")
+		writeFile(path, bytes.NewBufferString(merged))
+		err := os.Chmod(path, currentEntry.Mode())
+		if err != nil {
+			panic(err)
+		}
+		current[path] = BowlEntry{Hash: currentEntry.Hash, Path: path, Stat: FileStat{Mode: currentEntry.Stat.Mode}}
+		if mergeConflicts {
+			conflicts = true
+			fmt.Println("CONFLICT (content): Merge conflict in " + quotePath(path))
+		} else {
+			fmt.Println("Merged " + quotePath(path))
+		}
+	}
+
+	newBowl := []BowlEntry{}
+	for _, entry := range current {
+		newBowl = append(newBowl, entry)
+	}
+	writeBowl(bowlLock, newBowl)
+
+	if pop && conflicts {
+		fmt.Println("The stash entry is kept since there were conflicts.")
+	} else if pop {
+		stashDrop(index)
+	}
+}
+
+// Removes a stash entry from the reflog, and points the stash ref at the
+// newest remaining entry
+func stashDrop(index int) {
+	lock := mustLock(filepath.Join(REFS_PATH, STASH_REF))
+	defer lock.Release()
+	entries := readReflog(STASH_REF)
+	position := len(entries) - 1 - index
+	if position < 0 {
+		lock.Release()
+		fmt.Printf("stash@{%d} does not exist.\n", index)
+		os.Exit(1)
+	}
+	dropped := entries[position]
+	entries = slices.Delete(entries, position, position+1)
+
+	// Keep the old hashes of the remaining entries in sequence
+	for i := range entries {
+		if i == 0 {
+			entries[i].OldHash = strings.Repeat("0", len(entries[i].NewHash))
+		} else {
+			entries[i].OldHash = entries[i-1].NewHash
+		}
+	}
+
+	if len(entries) == 0 {
+		os.Remove(filepath.Join(LOGS_PATH, STASH_REF))
+		os.Remove(filepath.Join(REFS_PATH, STASH_REF))
+	} else {
+		writeReflog(STASH_REF, entries)
+		lock.Commit(bytes.NewBufferString(entries[len(entries)-1].NewHash))
+	}
+	fmt.Printf("Dropped stash@{%d} (%s)\n", index, dropped.NewHash)
+}
+
+func stashList() {
+	entries := readReflog(STASH_REF)
+	for i := range entries {
+		fmt.Printf("stash@{%d}: %s\n", i, entries[len(entries)-1-i].Message)
+	}
+}
+
+// Lists the paths a stash entry adds (A), modifies (M) or deletes (D)
+// relative to the flush it was made on
+func stashShow(index int) {
+	stash := getStashEntry(index)
+	base := getObject(stash.Base.TreeHash).ToTree().ToBowl()
+	wd := getObject(stash.Wd.TreeHash).ToTree().ToBowl()
+	for _, change := range plungeChanges(base, wd) {
+		fmt.Println(changeStatus(change) + " " + quotePath(change.Path))
+	}
+}
+
+func getStashEntry(index int) StashEntry {
+	entries := readReflog(STASH_REF)
+	if index >= len(entries) {
+		fmt.Printf("stash@{%d} does not exist.\n", index)
+		os.Exit(1)
+	}
+	wd := getFlush(entries[len(entries)-1-index].NewHash)
+	bowl := getFlush(wd.ParentHash)
+	return StashEntry{Base: getFlush(bowl.ParentHash), Bowl: bowl, Wd: wd}
+}
+
+func bowlMap(bowl []BowlEntry) map[string]BowlEntry {
+	entries := make(map[string]BowlEntry)
+	for _, entry := range bowl {
+		entries[entry.Path] = entry
+	}
+	return entries
+}
+
+// Returns whether a path has the same content and mode in two bowls, or is
+// in neither
+func sameEntry(a map[string]BowlEntry, b map[string]BowlEntry, path string) bool {
+	entryA, inA := a[path]
+	entryB, inB := b[path]
+	if !inA || !inB {
+		return inA == inB
+	}
+	return entryA.Hash == entryB.Hash && isExecutable(entryA.Mode()) == isExecutable(entryB.Mode())
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFile(path string) FileStat {
+	info, err := os.Lstat(path)
+	if err != nil {
+		panic(err)
+	}
+	sys := info.Sys().(*syscall.Stat_t)
+	return FileStat{
+		Ctime: syscall.TimespecToNsec(sys.Ctim),
+		Mtime: info.ModTime().UnixNano(),
+		Size:  info.Size(),
+		Inode: sys.Ino,
+		Mode:  uint32(info.Mode()),
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// Platforms without a Linux style stat_t fall back to the mtime for the ctime
+// and leave the inode unset.
+func statFile(path string) FileStat {
+	info, err := os.Lstat(path)
+	if err != nil {
+		panic(err)
+	}
+	return FileStat{
+		Ctime: info.ModTime().UnixNano(),
+		Mtime: info.ModTime().UnixNano(),
+		Size:  info.Size(),
+		Mode:  uint32(info.Mode()),
+	}
+}
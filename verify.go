@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	stdhash "hash" // Conflicts with the hash function of this package
+	"io"
+)
+
+const DEFAULT_OBJECT_FORMAT = "sha1"
+
+// Hash algorithms objects can be named by, selected per repository at init
+var OBJECT_FORMATS = map[string]func() stdhash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+func objectFormat() string {
+	return getConfig().Get("core.objectFormat", DEFAULT_OBJECT_FORMAT)
+}
+
+// Returns a hasher for the object format of the repository
+func newHasher() stdhash.Hash {
+	format := objectFormat()
+	newFunc, supported := OBJECT_FORMATS[format]
+	if !supported {
+		panic(fmt.Sprintf("Unsupported object format %s", format))
+	}
+	return newFunc()
+}
+
+type CorruptObjectError struct {
+	Hash       string
+	ActualHash string
+}
+
+func (err *CorruptObjectError) Error() string {
+	return fmt.Sprintf("Object %s is corrupt, its content hashes to %s", err.Hash, err.ActualHash)
+}
+
+// Hashes an object as it is read and fails at the end of the object if the
+// content does not match the object name
+type verifyingReader struct {
+	io.ReadCloser
+	hash   string
+	hasher stdhash.Hash
+}
+
+func (reader *verifyingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.hasher.Write(p[:n])
+	if err == io.EOF {
+		actual := hex.EncodeToString(reader.hasher.Sum(nil))
+		if actual != reader.hash {
+			return n, &CorruptObjectError{Hash: reader.hash, ActualHash: actual}
+		}
+	}
+	return n, err
+}